@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// urlStats summarizes the load durations of a resource across all the page
+// loads retained in the store. The percentiles are in milliseconds.
+type urlStats struct {
+	URL           string  `json:"url"`
+	InitiatorType string  `json:"initiatorType"`
+	Count         int     `json:"count"`
+	P50           float64 `json:"p50Ms"`
+	P95           float64 `json:"p95Ms"`
+	P99           float64 `json:"p99Ms"`
+}
+
+// Aggregate serves the percentiles of the load durations of each resource
+// URL across all page loads currently retained in the store, as JSON, slowest
+// (by p95) first. It tells resources which are consistently slow from ones
+// which were slow once.
+func (a *App) Aggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	traces, err := a.Queryer.Traces()
+	if err != nil {
+		slog.Error("querying traces", "handler", "aggregate", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+
+	byURL := make(map[string][]time.Duration)
+	initiator := make(map[string]string)
+	for _, e := range resourceEvents(traces) {
+		byURL[e.URL] = append(byURL[e.URL], e.Duration)
+		initiator[e.URL] = e.InitiatorType
+	}
+	stats := make([]urlStats, 0, len(byURL))
+	for u, ds := range byURL {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		stats = append(stats, urlStats{
+			URL:           u,
+			InitiatorType: initiator[u],
+			Count:         len(ds),
+			P50:           percentile(ds, 50),
+			P95:           percentile(ds, 95),
+			P99:           percentile(ds, 99),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].P95 != stats[j].P95 {
+			return stats[i].P95 > stats[j].P95
+		}
+		return stats[i].URL < stats[j].URL
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
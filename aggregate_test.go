@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	for i, ms := range []int{300, 100, 200} {
+		ingest(t, a, fmt.Sprintf(`{"v": 1, "entries": [
+			{"sessionId": "session-%d", "name": "/a.js", "entryType": "resource", "initiatorType": "script", "startOffsetMs": 10, "durationMs": %d}
+		]}`, i, ms))
+	}
+	ingest(t, a, `{"v": 1, "entries": [
+		{"sessionId": "session-b", "name": "/b.css", "entryType": "resource", "initiatorType": "link", "startOffsetMs": 10, "durationMs": 50}
+	]}`)
+
+	w := get(a.Aggregate, "/aggregate")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var stats []urlStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	want := []urlStats{
+		{URL: "/a.js", InitiatorType: "script", Count: 3, P50: 200, P95: 300, P99: 300},
+		{URL: "/b.css", InitiatorType: "link", Count: 1, P50: 50, P95: 50, P99: 50},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d URLs, want %d: %+v", len(stats), len(want), stats)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("got %+v, want %+v", stats[i], want[i])
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	w := httptest.NewRecorder()
+	a.Aggregate(w, httptest.NewRequest("POST", "/aggregate", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Spans sent to a remote collector can't be aggregated here.
+	a.Queryer = nil
+	if w := get(a.Aggregate, "/aggregate"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("no store: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
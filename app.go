@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// App is the loadtimes web application: it serves the sample page (Home) and
+// records the browser timings the page posts to Endpoint as Appdash traces.
+// Its handlers only depend on the App, so several of them, configured
+// differently, can run side by side.
+type App struct {
+	// Collector records the spans of the page loads, and of the requests
+	// which served them.
+	Collector appdash.Collector
+
+	// Queryer reads the recorded traces back, for Stats, HAR and Summary.
+	// It is nil when the traces are stored elsewhere (e.g. with -collector),
+	// and so can't be read back.
+	Queryer appdash.Queryer
+
+	// Sessions tracks the page loads currently posting to Endpoint, see
+	// sessionRegistry.
+	Sessions *sessionRegistry
+
+	// RateLimiter, if non-nil, limits the rate at which each client may
+	// post to Endpoint (see Config.RateLimit).
+	RateLimiter *rateLimiter
+
+	// Broadcaster publishes a summary of each batch Endpoint records to
+	// the clients of Stream.
+	Broadcaster *broadcaster
+
+	// Dedupe, if non-nil, keeps payloads posted more than once from being
+	// recorded again.
+	Dedupe *dedupeCache
+
+	// Sampler, if non-nil, decides which payloads are recorded (see
+	// Config.SampleRate).
+	Sampler *sampler
+
+	// CollectStatus counts the errors recording spans, for Readyz.
+	CollectStatus *collectStatus
+
+	// ReadyCheck, if non-nil, checks that what the app depends on (e.g. the
+	// web UI or a remote collector) is up: Readyz reports the app unready
+	// while it fails.
+	ReadyCheck func() error
+
+	Config
+}
+
+// Config is how an App records and links to traces. Its fields are set from
+// the command-line flags of the same names.
+type Config struct {
+	UIAddr       string        // -ui-addr, to link to the web UI
+	UIBaseURL    string        // -ui-base-url, to link to the web UI behind a proxy
+	AppAddr      string        // -app-addr, for Home to call this app's API
+	APITimeout   time.Duration // -api-timeout
+	EndpointURL  string        // -endpoint-url
+	TLS          bool          // whether the app and web UI are served over HTTPS
+	CORSOrigin   string        // -cors-origin
+	MaxBody      int64         // -max-body, or defaultMaxBody if zero
+	IncludeTypes string        // -include-types
+	SkipCached   bool          // -skip-cached
+	GroupByPath  bool          // -group-by-path
+
+	// SlowThreshold and SizeThreshold flag the resources which take longer
+	// to load, or transfer more bytes, as slow or large (-slow-threshold
+	// and -size-threshold). Zero disables either.
+	SlowThreshold time.Duration
+	SizeThreshold int64
+
+	// SessionAge is how long page sessions are remembered, normally as
+	// long as their traces are (-evict-age). Zero or less means
+	// defaultSessionAge.
+	SessionAge time.Duration
+
+	// RateLimit and RateBurst limit the rate of posts to Endpoint per
+	// client IP (-rate-limit and -rate-burst). A zero RateLimit disables
+	// rate limiting.
+	RateLimit float64
+	RateBurst int
+
+	// SampleRate is the fraction of the page loads posting to Endpoint
+	// which are recorded (-sample-rate): 1 or more records them all, and
+	// less than zero none. Zero, i.e. unset, records them all too.
+	SampleRate float64
+
+	// DedupeWindow is how long Endpoint remembers payloads, so as to
+	// record each only once (-dedupe-window). Zero disables deduplication.
+	DedupeWindow time.Duration
+
+	// RetryOnCollectError makes Endpoint reply 503 to payloads it failed
+	// to record, so that clients may retry them
+	// (-retry-on-collect-error).
+	RetryOnCollectError bool
+}
+
+// defaultSessionAge is how long page sessions are remembered when trace
+// eviction is disabled.
+const defaultSessionAge = 30 * time.Minute
+
+// defaultMaxBody is the default of -max-body.
+const defaultMaxBody = 1 << 20
+
+// NewApp returns an App recording spans into c. q reads them back, and may
+// be nil if they can't be. It fails if cfg is invalid.
+func NewApp(c appdash.Collector, q appdash.Queryer, cfg Config) (*App, error) {
+	if err := checkEndpointURL(cfg.EndpointURL); err != nil {
+		return nil, fmt.Errorf("invalid endpoint URL %q: %w", cfg.EndpointURL, err)
+	}
+	if cfg.SessionAge <= 0 {
+		cfg.SessionAge = defaultSessionAge
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = defaultMaxBody
+	}
+	a := &App{
+		Collector:     c,
+		Queryer:       q,
+		Sessions:      newSessionRegistry(cfg.SessionAge),
+		Broadcaster:   newBroadcaster(),
+		CollectStatus: &collectStatus{},
+		Config:        cfg,
+	}
+	if cfg.RateLimit > 0 {
+		a.RateLimiter = newRateLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+	}
+	if cfg.DedupeWindow > 0 {
+		a.Dedupe = newDedupeCache(dedupeSize, cfg.DedupeWindow)
+	}
+	if cfg.SampleRate != 0 && cfg.SampleRate < 1 {
+		a.Sampler = newSampler(cfg.SampleRate)
+	}
+	return a, nil
+}
+
+// Flush sends on the spans buffered by the collector, if it buffers any
+// (such as appdash.ChunkedCollector), so that none is lost on shutdown. It
+// gives up when ctx is done, so that a stuck remote collector can't hold up
+// termination forever; the spans still buffered are then dropped.
+func (a *App) Flush(ctx context.Context) error {
+	f, ok := a.Collector.(flusher)
+	if !ok {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- f.Flush() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sourcegraph.com/sourcegraph/appdash"
+	"sourcegraph.com/sourcegraph/appdash/httptrace"
+)
+
+// captureCollector is an appdash.Collector which keeps everything collected,
+// so that tests can check what a handler recorded.
+type captureCollector struct {
+	// err, if set, is returned by Collect, which then keeps nothing.
+	err error
+
+	mu    sync.Mutex
+	spans []appdash.SpanID // in the order first collected
+	anns  map[appdash.SpanID]appdash.Annotations
+}
+
+// Collect implements the appdash.Collector interface.
+func (c *captureCollector) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.anns == nil {
+		c.anns = make(map[appdash.SpanID]appdash.Annotations)
+	}
+	if _, ok := c.anns[id]; !ok {
+		c.spans = append(c.spans, id)
+	}
+	c.anns[id] = append(c.anns[id], as...)
+	return nil
+}
+
+// annotations returns the annotations collected for the span id.
+func (c *captureCollector) annotations(id appdash.SpanID) appdash.Annotations {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.anns[id]
+}
+
+// withEvent returns the spans carrying an event of the given schema, in the
+// order they were first collected.
+func (c *captureCollector) withEvent(schema string) []appdash.SpanID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []appdash.SpanID
+	for _, id := range c.spans {
+		for _, a := range c.anns[id] {
+			if a.Key == appdash.SchemaPrefix+schema {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// named returns the span named name, or false if there is none.
+func (c *captureCollector) named(name string) (appdash.SpanID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range c.spans {
+		s := appdash.Span{ID: id, Annotations: c.anns[id]}
+		if s.Name() == name {
+			return id, true
+		}
+	}
+	return appdash.SpanID{}, false
+}
+
+// children returns the spans collected as children of parent.
+func (c *captureCollector) children(parent appdash.SpanID) []appdash.SpanID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []appdash.SpanID
+	for _, id := range c.spans {
+		if id.Trace == parent.Trace && id.Parent == parent.Span {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// event unmarshals the event e recorded on the span id, failing the test if
+// there is none.
+func (c *captureCollector) event(t *testing.T, id appdash.SpanID, e appdash.Event) {
+	t.Helper()
+	if err := appdash.UnmarshalEvent(c.annotations(id), e); err != nil {
+		t.Fatalf("span %s: unmarshaling %s event: %s", id, e.Schema(), err)
+	}
+}
+
+// resources returns the resource events recorded, by span name.
+func (c *captureCollector) resources(t *testing.T) map[string]ResourceEvent {
+	t.Helper()
+	m := make(map[string]ResourceEvent)
+	for _, id := range c.withEvent("Resource") {
+		var e ResourceEvent
+		c.event(t, id, &e)
+		m[(&appdash.Span{ID: id, Annotations: c.annotations(id)}).Name()] = e
+	}
+	return m
+}
+
+// newTestApp returns an App recording into a captureCollector, configured as
+// by the default flags except for cfg's non-zero fields.
+func newTestApp(cfg Config) (*App, *captureCollector) {
+	if cfg.AppAddr == "" {
+		cfg.AppAddr = ":8699"
+	}
+	if cfg.UIAddr == "" {
+		cfg.UIAddr = ":8700"
+	}
+	c := &captureCollector{}
+	a, err := NewApp(c, nil, cfg)
+	if err != nil {
+		panic(err) // the tests' configurations are valid
+	}
+	return a, c
+}
+
+// postPayload posts body to a's Endpoint at target (e.g. "/endpoint" or
+// "/endpoint?session=s1") as JSON, and returns the response.
+func postPayload(a *App, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	a.Endpoint(w, req)
+	return w
+}
+
+// testPayload is a beacon as posted by the sample page: the navigation entry
+// of the page and three resources, the last one cross-origin without
+// Timing-Allow-Origin.
+const testPayload = `{"v": 1, "entries": [
+	{"sessionId": "test-session", "pageUrl": "http://localhost:8699/", "pagePath": "/",
+	 "name": "http://localhost:8699/", "entryType": "navigation",
+	 "startOffsetMs": 0, "durationMs": 480.5, "requestStart": 20, "responseStart": 120, "responseEnd": 150,
+	 "domInteractive": 300, "domContentLoadedEventStart": 310, "domContentLoadedEventEnd": 320,
+	 "domComplete": 470, "loadEventEnd": 480.5},
+	{"sessionId": "test-session", "name": "https://cdn.example.com/app.js", "entryType": "resource",
+	 "initiatorType": "script", "protocol": "h2", "startOffsetMs": 130.25, "durationMs": 95.5,
+	 "domainLookupStart": 130.25, "domainLookupEnd": 140, "connectStart": 140, "secureConnectionStart": 150,
+	 "connectEnd": 170, "requestStart": 170.5, "responseStart": 200, "responseEnd": 225.75,
+	 "transferSize": 20480, "encodedBodySize": 20000, "decodedBodySize": 61000, "status": 200},
+	{"sessionId": "test-session", "name": "http://localhost:8699/style.css", "entryType": "resource",
+	 "initiatorType": "link", "protocol": "http/1.1", "startOffsetMs": 131, "durationMs": 40,
+	 "requestStart": 135, "responseStart": 160, "responseEnd": 171,
+	 "transferSize": 3000, "encodedBodySize": 2700, "decodedBodySize": 9000, "status": 200},
+	{"sessionId": "test-session", "name": "https://fonts.example.net/font.woff2", "entryType": "resource",
+	 "initiatorType": "css", "startOffsetMs": 230, "durationMs": 60}
+]}`
+
+func TestEndpoint(t *testing.T) {
+	a, c := newTestApp(Config{})
+	w := postPayload(a, "/endpoint", testPayload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	for schema, want := range map[string]int{"Page": 1, "Navigation": 1, "Resource": 3} {
+		if got := len(c.withEvent(schema)); got != want {
+			t.Errorf("got %d spans with a %s event, want %d", got, schema, want)
+		}
+	}
+	// The root span, the three resources, the five network phases of
+	// app.js and the two (TTFB and Content Download) of style.css. The
+	// font's timings are opaque, so it has no phases.
+	if got, want := len(c.spans), 1+3+5+2; got != want {
+		t.Errorf("got %d spans, want %d", got, want)
+	}
+}
+
+// blockingFlusher is a collector whose Flush never returns.
+type blockingFlusher struct{ captureCollector }
+
+func (*blockingFlusher) Flush() error { select {} }
+
+func TestShutdown(t *testing.T) {
+	c := &captureCollector{}
+	chunked := appdash.NewChunkedCollector(c)
+	chunked.MinInterval = time.Hour // flushed on shutdown only
+	defer chunked.Stop()
+	a, _ := newTestApp(Config{})
+	a.Collector = chunked
+
+	appServer := &http.Server{Handler: http.HandlerFunc(a.Endpoint)}
+	appServer.RegisterOnShutdown(a.Broadcaster.close)
+	uiServer := &http.Server{Handler: http.NotFoundHandler()}
+	for _, s := range []*http.Server{appServer, uiServer} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Addr = l.Addr().String()
+		go s.Serve(l)
+	}
+
+	resp, err := http.Post("http://"+appServer.Addr+"/endpoint", "application/json", strings.NewReader(testPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(c.spans) != 0 {
+		t.Fatalf("%d spans collected before the flush, want them buffered", len(c.spans))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, s := range []*http.Server{appServer, uiServer} {
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down %s: %s", s.Addr, err)
+		}
+	}
+	if err := a.Flush(ctx); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	if len(c.withEvent("Resource")) != 3 {
+		t.Errorf("got %d resources after the flush, want 3", len(c.withEvent("Resource")))
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	a, _ := newTestApp(Config{})
+	a.Collector = &blockingFlusher{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Collectors which buffer nothing have nothing to flush.
+	a.Collector = &captureCollector{}
+	if err := a.Flush(ctx); err != nil {
+		t.Errorf("not a flusher: got error %v", err)
+	}
+}
+
+// serveApp serves a's handlers on a test server which a calls itself on, as
+// it would on -app-addr.
+func serveApp(t *testing.T, a *App) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.Home)
+	mux.HandleFunc("/api", API)
+	mux.HandleFunc("/endpoint", a.Endpoint)
+	mux.HandleFunc("/loadPerformanceData.js", ClientScript)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	a.AppAddr = srv.Listener.Addr().String()
+}
+
+// getHome requests a's Home page as traced by the span id, as the appdash
+// middleware would set it up, and returns the response.
+func getHome(a *App, id appdash.SpanID) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	gcontext.Set(req, CtxSpanID, id)
+	defer gcontext.Clear(req)
+	w := httptest.NewRecorder()
+	a.Home(w, req)
+	return w
+}
+
+func TestNewAppZeroConfig(t *testing.T) {
+	// The zero Config records every payload, as the flags' defaults do.
+	c := &captureCollector{}
+	a, err := NewApp(c, nil, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Sampler != nil {
+		t.Error("got a sampler, want every payload recorded")
+	}
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := len(c.withEvent("Resource")); got != 3 {
+		t.Errorf("got %d resources recorded, want 3", got)
+	}
+}
+
+func TestAppHandlers(t *testing.T) {
+	a, c := newTestApp(Config{})
+	serveApp(t, a)
+
+	page := appdash.NewRootSpanID()
+	w := getHome(a, page)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Home: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{`"/endpoint"`, page.String(), "/traces/" + page.Trace.String()} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Home: page doesn't contain %q", want)
+		}
+	}
+	// Home's own API calls succeed, and are traced under the page's span.
+	var calls int
+	for _, id := range c.children(page) {
+		var e httptrace.ClientEvent
+		if appdash.UnmarshalEvent(c.annotations(id), &e) != nil {
+			continue
+		}
+		calls++
+		if e.Response.StatusCode != http.StatusOK {
+			t.Errorf("Home: API call to %s got status %d, want %d", e.Request.URI, e.Response.StatusCode, http.StatusOK)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Home: got %d API calls traced under the page's span, want 3", calls)
+	}
+
+	// The page's beacon is recorded into the page's trace.
+	beacon := fmt.Sprintf(`{"v": 1, "entries": [{"pageTraceId": %q, "name": "/a.js", "startOffsetMs": 10, "durationMs": 20}]}`, page.String())
+	if w := postPayload(a, "/endpoint", beacon); w.Code != http.StatusOK {
+		t.Fatalf("Endpoint: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	id, ok := c.named("/a.js")
+	if !ok {
+		t.Fatal("Endpoint: /a.js not recorded")
+	}
+	if id.Trace != page.Trace {
+		t.Errorf("Endpoint: /a.js recorded into trace %s, want the page's %s", id.Trace, page.Trace)
+	}
+}
+
+func TestHomeTraceLink(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  Config
+		want string // the UI's base URL
+	}{
+		{Config{UIAddr: "127.0.0.1:9000"}, "http://127.0.0.1:9000"},
+		// With no host, the UI is reached like the app (example.com in
+		// httptest requests).
+		{Config{UIAddr: ":8700"}, "http://example.com:8700"},
+		{Config{UIBaseURL: "https://rum.example.com/appdash/"}, "https://rum.example.com/appdash"},
+	} {
+		a, _ := newTestApp(tt.cfg)
+		serveApp(t, a)
+		page := appdash.NewRootSpanID()
+		body := getHome(a, page).Body.String()
+		for _, href := range []string{
+			`href="` + tt.want + "/traces/" + page.Trace.String() + `"`,
+			`href="` + tt.want + `/traces"`,
+		} {
+			if !strings.Contains(body, href) {
+				t.Errorf("%+v: page doesn't link %s", tt.cfg, href)
+			}
+		}
+	}
+}
+
+func TestHomeAPICalls(t *testing.T) {
+	a, c := newTestApp(Config{})
+	serveApp(t, a)
+	rejected := testutil.ToFloat64(payloadsRejected.WithLabelValues("method"))
+
+	// The browser reached the app under a name of its own (as covered by
+	// its certificate), which the calls use but connect to the app directly.
+	page := appdash.NewRootSpanID()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "rum.example.com:8443"
+	gcontext.Set(req, CtxSpanID, page)
+	defer gcontext.Clear(req)
+	a.Home(httptest.NewRecorder(), req)
+
+	_, port, _ := net.SplitHostPort(a.AppAddr)
+	want := "http://rum.example.com:" + port + "/api"
+	var calls int
+	for _, id := range c.children(page) {
+		var e httptrace.ClientEvent
+		if appdash.UnmarshalEvent(c.annotations(id), &e) != nil {
+			continue
+		}
+		calls++
+		if e.Request.URI != want || e.Response.StatusCode != http.StatusOK {
+			t.Errorf("got a call to %s with status %d, want one to %s with status %d", e.Request.URI, e.Response.StatusCode, want, http.StatusOK)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("got %d API calls, want 3", calls)
+	}
+	// The calls don't go to /endpoint, which would reject them.
+	if got := testutil.ToFloat64(payloadsRejected.WithLabelValues("method")) - rejected; got != 0 {
+		t.Errorf("%v payloads rejected for their method, want none", got)
+	}
+}
+
+func TestNewAppEndpointURL(t *testing.T) {
+	for _, tt := range []struct {
+		url string
+		ok  bool
+	}{
+		{"", true},
+		{"/endpoint", true},
+		{"https://rum.example.com/endpoint", true},
+		{"http://192.0.2.10:8699/endpoint", true},
+		{"endpoint", false},
+		{"https:///endpoint", false},
+		{"ftp://rum.example.com/endpoint", false},
+		{"javascript:alert(1)", false},
+		{"//rum.example.com/endpoint", false},
+		{"http://[::1", false},
+	} {
+		a, err := NewApp(&captureCollector{}, nil, Config{EndpointURL: tt.url})
+		if tt.ok && (err != nil || a == nil) {
+			t.Errorf("%q: got error %v, want none", tt.url, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q: got no error", tt.url)
+		}
+	}
+}
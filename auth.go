@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// basicAuth wraps the handler next, letting through only requests carrying
+// the given HTTP Basic Auth credentials. The traces it serves can include
+// sensitive URLs and user identifiers.
+func basicAuth(next http.Handler, user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || !secureEqual(u, user) || !secureEqual(p, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="loadtimes", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secureEqual reports whether a and b are equal in constant time. They are
+// hashed first so that not even their lengths leak through timing.
+func secureEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -0,0 +1,51 @@
+package main
+
+import "sourcegraph.com/sourcegraph/appdash"
+
+// spanBatch is an appdash.Collector which buffers everything collected for
+// each span in memory, until Flush sends it on to the underlying collector
+// with exactly one Collect call per span.
+//
+// Endpoint records a span per resource plus up to six per resource for its
+// network phases, each with a name and an event, and the appdash Recorder
+// may send each of those to the collector separately. For a page with 200
+// resources that is 2800 Collect calls (each taking the store's lock, or a
+// round-trip to a remote collector) per beacon; batching merges them into
+// one call per span, 1400 in that case, all made after the payload has been
+// fully processed. See TestSpanBatchCollectCalls.
+//
+// A spanBatch is not safe for concurrent use.
+type spanBatch struct {
+	c     appdash.Collector
+	spans []appdash.SpanID // in the order first collected
+	anns  map[appdash.SpanID][]appdash.Annotation
+}
+
+// newSpanBatch returns a batch which flushes to c.
+func newSpanBatch(c appdash.Collector) *spanBatch {
+	return &spanBatch{c: c, anns: make(map[appdash.SpanID][]appdash.Annotation)}
+}
+
+// Collect implements the appdash.Collector interface.
+func (b *spanBatch) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	if _, ok := b.anns[id]; !ok {
+		b.spans = append(b.spans, id)
+	}
+	b.anns[id] = append(b.anns[id], as...)
+	return nil
+}
+
+// Flush sends the buffered spans to the underlying collector and empties
+// the batch. It returns the first error encountered, but still attempts to
+// send every span.
+func (b *spanBatch) Flush() error {
+	var firstErr error
+	for _, id := range b.spans {
+		if err := b.c.Collect(id, b.anns[id]...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.spans = nil
+	b.anns = make(map[appdash.SpanID][]appdash.Annotation)
+	return firstErr
+}
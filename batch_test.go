@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// countingCollector counts the Collect calls made to it, and the distinct
+// spans they were for.
+type countingCollector struct {
+	mu    sync.Mutex
+	calls int
+	spans map[appdash.SpanID]bool
+}
+
+func (c *countingCollector) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spans == nil {
+		c.spans = make(map[appdash.SpanID]bool)
+	}
+	c.calls++
+	c.spans[id] = true
+	return nil
+}
+
+// resourcesPayload returns a payload of n resources, each with all of its
+// network phases.
+func resourcesPayload(n int) string {
+	entries := make([]string, n)
+	for i := range entries {
+		entries[i] = fmt.Sprintf(`{"name": "/r%d.js", "entryType": "resource", "initiatorType": "script",
+			"startOffsetMs": 10, "durationMs": 100, "redirectStart": 10, "redirectEnd": 20,
+			"domainLookupStart": 20, "domainLookupEnd": 30, "connectStart": 30, "connectEnd": 50,
+			"secureConnectionStart": 40, "requestStart": 50, "responseStart": 80, "responseEnd": 110}`, i)
+	}
+	return `{"v": 1, "entries": [` + strings.Join(entries, ",") + `]}`
+}
+
+// collectCalls records the payload of n resources into a counting collector,
+// through a spanBatch or not, and returns it.
+func collectCalls(t testing.TB, n int, batched bool) *countingCollector {
+	t.Helper()
+	calls, err := decodePayload([]byte(resourcesPayload(n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := newTestApp(Config{})
+	c := &countingCollector{}
+	var into appdash.Collector = c
+	batch := newSpanBatch(c)
+	if batched {
+		into = batch
+	}
+	a.recordEntries(into, appdash.NewRootSpanID(), time.Now(), ClientInfo{}, calls)
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSpanBatchCollectCalls(t *testing.T) {
+	direct := collectCalls(t, 200, false)
+	batched := collectCalls(t, 200, true)
+	if len(batched.spans) != len(direct.spans) {
+		t.Fatalf("batched: got %d spans, want %d", len(batched.spans), len(direct.spans))
+	}
+	// A span per resource, plus one per network phase.
+	if len(direct.spans) <= 200 {
+		t.Fatalf("got %d spans, want a span per resource and phase", len(direct.spans))
+	}
+	if batched.calls != len(batched.spans) {
+		t.Errorf("batched: got %d Collect calls for %d spans, want one per span", batched.calls, len(batched.spans))
+	}
+	if direct.calls <= batched.calls {
+		t.Errorf("got %d Collect calls directly and %d batched, want fewer batched", direct.calls, batched.calls)
+	}
+	t.Logf("200 resources: %d spans, %d Collect calls directly, %d batched", len(direct.spans), direct.calls, batched.calls)
+}
+
+func BenchmarkRecordEntries(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%t", batched), func(b *testing.B) {
+			var calls int
+			for i := 0; i < b.N; i++ {
+				calls += collectCalls(b, 200, batched).calls
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "collects/op")
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cors wraps the handler next with CORS support, so that pages on other
+// origins (allowed by -cors-origin) can post to it. Preflight OPTIONS
+// requests are answered directly without calling next, and requests from
+// origins -cors-origin doesn't allow are refused with 403 Forbidden. Pages on
+// the app's own origin are always allowed.
+func (a *App) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) {
+			allowed, ok := a.corsAllowOrigin(origin)
+			if !ok {
+				payloadsRejected.WithLabelValues("origin").Inc()
+				writeJSONError(w, http.StatusForbidden, "origin not allowed", origin)
+				return
+			}
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				h.Add("Vary", "Origin")
+			}
+			h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Idempotency-Key")
+		}
+		if r.Method == "OPTIONS" {
+			// Beacons are posted on every page load, so let the browser
+			// cache the preflight rather than repeating it each time.
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// sameOrigin reports whether origin, the Origin header of r, is the origin r
+// was sent to. Browsers send Origin with same-origin POSTs and WebSocket
+// handshakes too, which -cors-origin has no say over.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value to send to a
+// request from origin, and whether -cors-origin allows it at all.
+func (a *App) corsAllowOrigin(origin string) (string, bool) {
+	for _, o := range strings.Split(a.CORSOrigin, ",") {
+		switch o = strings.TrimSpace(o); o {
+		case "*":
+			return "*", true
+		case origin:
+			return origin, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	a, c := newTestApp(Config{CORSOrigin: "https://shop.example.com"})
+	req := httptest.NewRequest("OPTIONS", "/endpoint", nil)
+	req.Header.Set("Origin", "https://shop.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	a.cors(a.Endpoint)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://shop.example.com",
+		"Access-Control-Allow-Methods": "POST, OPTIONS",
+		"Vary":                         "Origin",
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+	}
+	if h := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(h, "Content-Type") {
+		t.Errorf("Access-Control-Allow-Headers %q doesn't allow Content-Type", h)
+	}
+	if len(c.spans) != 0 {
+		t.Errorf("preflight recorded %d spans", len(c.spans))
+	}
+}
+
+func TestCORSPost(t *testing.T) {
+	for _, tt := range []struct {
+		corsOrigin, origin string
+		status             int
+		allowOrigin        string
+	}{
+		{"*", "https://shop.example.com", http.StatusOK, "*"},
+		{"https://a.example.com, https://shop.example.com", "https://shop.example.com", http.StatusOK, "https://shop.example.com"},
+		{"https://a.example.com", "https://shop.example.com", http.StatusForbidden, ""},
+		// Browsers send Origin on same-origin POSTs too: the app's own
+		// pages may always post. (httptest requests are sent to
+		// example.com.)
+		{"https://a.example.com", "http://example.com", http.StatusOK, ""},
+		{"https://a.example.com", "http://example.com:8080", http.StatusForbidden, ""},
+		// Clients other than browsers may send no Origin at all.
+		{"https://a.example.com", "", http.StatusOK, ""},
+	} {
+		a, c := newTestApp(Config{CORSOrigin: tt.corsOrigin})
+		req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		a.cors(a.Endpoint)(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("-cors-origin %q, origin %q: got status %d, want %d", tt.corsOrigin, tt.origin, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("-cors-origin %q, origin %q: got Access-Control-Allow-Origin %q, want %q", tt.corsOrigin, tt.origin, got, tt.allowOrigin)
+		}
+		if recorded := len(c.spans) > 0; recorded != (tt.status == http.StatusOK) {
+			t.Errorf("-cors-origin %q, origin %q: recorded spans: %t", tt.corsOrigin, tt.origin, recorded)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupeSize is how many recent payloads are remembered at most, to tell
+// retries apart.
+const dedupeSize = 10000
+
+// dedupeCache remembers the keys of the payloads Endpoint recently recorded,
+// so that a payload posted again (e.g. a beacon retried by the network
+// stack) isn't recorded twice. It is a bounded LRU: the least recently seen
+// keys are forgotten first.
+type dedupeCache struct {
+	size   int
+	window time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List // of *dedupeEntry, most recently seen first
+	items map[string]*list.Element
+}
+
+// dedupeEntry is a key of dedupeCache and when it was first seen, i.e. when
+// its payload was recorded.
+type dedupeEntry struct {
+	key  string
+	seen time.Time
+}
+
+// newDedupeCache returns a cache of up to size keys, each remembered for
+// window.
+func newDedupeCache(size int, window time.Duration) *dedupeCache {
+	return &dedupeCache{
+		size:   size,
+		window: window,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// seen records key as seen at now, and reports whether it had already been
+// seen within the window before. The window runs from when the key was first
+// seen: a payload retried over and over is still recorded again once it has
+// passed, rather than each retry holding it off for another window.
+func (d *dedupeCache) seen(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[key]; ok {
+		e := el.Value.(*dedupeEntry)
+		d.ll.MoveToFront(el)
+		if now.Sub(e.seen) <= d.window {
+			return true
+		}
+		e.seen = now
+		return false
+	}
+	d.items[key] = d.ll.PushFront(&dedupeEntry{key: key, seen: now})
+	for d.ll.Len() > d.size {
+		oldest := d.ll.Back()
+		d.ll.Remove(oldest)
+		delete(d.items, oldest.Value.(*dedupeEntry).key)
+	}
+	return false
+}
+
+// forget forgets key, so that it is no longer seen.
+func (d *dedupeCache) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[key]; ok {
+		d.ll.Remove(el)
+		delete(d.items, key)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointDedupe(t *testing.T) {
+	a, c := newTestApp(Config{DedupeWindow: time.Minute})
+	var traces []string
+	for i := 0; i < 2; i++ {
+		w := postPayload(a, "/endpoint", testPayload)
+		if w.Code != http.StatusOK {
+			t.Fatalf("post %d: got status %d, want %d: %s", i, w.Code, http.StatusOK, w.Body)
+		}
+		var resp endpointResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Duplicate != (i == 1) {
+			t.Errorf("post %d: got duplicate %t", i, resp.Duplicate)
+		}
+		if resp.Trace != "" {
+			traces = append(traces, resp.Trace)
+		}
+	}
+	if len(traces) != 1 {
+		t.Errorf("got traces %q, want one", traces)
+	}
+	if got := len(c.withEvent("Resource")); got != 3 {
+		t.Errorf("got %d resources, want 3 recorded once", got)
+	}
+
+	// Payloads with different Idempotency-Keys are different payloads.
+	a, c = newTestApp(Config{DedupeWindow: time.Minute})
+	for _, key := range []string{"beacon-1", "beacon-2", "beacon-1"} {
+		req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		a.Endpoint(httptest.NewRecorder(), req)
+	}
+	if got := len(c.withEvent("Resource")); got != 6 {
+		t.Errorf("Idempotency-Key: got %d resources, want 6 recorded from two payloads", got)
+	}
+}
+
+func TestDedupeCache(t *testing.T) {
+	d := newDedupeCache(2, time.Minute)
+	now := time.Now()
+	if d.seen("a", now) {
+		t.Error("a seen before it was")
+	}
+	if !d.seen("a", now.Add(30*time.Second)) {
+		t.Error("a not seen within the window")
+	}
+	if d.seen("a", now.Add(5*time.Minute)) {
+		t.Error("a seen past the window")
+	}
+
+	// The window runs from when a key was first seen, not last.
+	d.seen("r", now)
+	if !d.seen("r", now.Add(40*time.Second)) {
+		t.Error("r not seen within the window")
+	}
+	if d.seen("r", now.Add(80*time.Second)) {
+		t.Error("r seen 80s after it was first seen: the window slid")
+	}
+	if !d.seen("r", now.Add(100*time.Second)) {
+		t.Error("r not seen within the window since it was seen again")
+	}
+
+	// Bounded: the least recently seen key goes first.
+	d.seen("b", now)
+	d.seen("a", now)
+	d.seen("c", now)
+	if len(d.items) != 2 || d.ll.Len() != 2 {
+		t.Errorf("got %d keys, want 2", len(d.items))
+	}
+	if d.seen("b", now) {
+		t.Error("b still remembered past the cache size")
+	}
+}
+
+func TestEndpointDedupeBySession(t *testing.T) {
+	// Two loads of the same page from behind the same IP post the same
+	// entries, but are different page loads.
+	a, c := newTestApp(Config{DedupeWindow: time.Minute})
+	for _, body := range []string{
+		testPayload,
+		strings.ReplaceAll(testPayload, "test-session", "other-session"),
+		testPayload,
+	} {
+		if w := postPayload(a, "/endpoint", body); w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+	if got := len(c.withEvent("Resource")); got != 6 {
+		t.Errorf("got %d resources, want 6 recorded from two page loads", got)
+	}
+
+	// The session may be given in the query instead.
+	a, c = newTestApp(Config{DedupeWindow: time.Minute})
+	const body = `[{"name": "/a.js", "entryType": "resource", "startOffsetMs": 1, "durationMs": 2}]`
+	for _, target := range []string{"/endpoint?session=s1", "/endpoint?session=s2", "/endpoint?session=s1"} {
+		postPayload(a, target, body)
+	}
+	if got := len(c.withEvent("Resource")); got != 2 {
+		t.Errorf("?session: got %d resources, want 2 recorded from two page loads", got)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// invalidDomain is the domain resources whose URL can't be parsed are
+// grouped under.
+const invalidDomain = "invalid"
+
+// domainSummary totals the resources of a page load fetched from one domain.
+type domainSummary struct {
+	Domain     string  `json:"domain"`
+	Count      int     `json:"count"`
+	DurationMs float64 `json:"totalDurationMs"`
+	TotalBytes int64   `json:"totalTransferBytes"`
+}
+
+// Domains serves the resources of the trace given by the trace query
+// parameter grouped by the host they were fetched from, as JSON, the domain
+// with the largest total load duration first. Third-party domains often
+// account for much of a page's load time.
+func (a *App) Domains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	id, err := appdash.ParseID(r.URL.Query().Get("trace"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid trace ID", err.Error())
+		return
+	}
+	trace, err := a.findTrace(id)
+	if err != nil {
+		slog.Error("querying traces", "handler", "domains", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+	if trace == nil {
+		writeJSONError(w, http.StatusNotFound, "trace not found", id.String())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domainSummaries(resourceEvents([]*appdash.Trace{trace})))
+}
+
+// domainSummaries groups the resource events by the host of their URL,
+// sorted by total duration, longest first.
+func domainSummaries(events []ResourceEvent) []domainSummary {
+	byDomain := make(map[string]*domainSummary)
+	for _, e := range events {
+		d := resourceDomain(e.URL)
+		s, ok := byDomain[d]
+		if !ok {
+			s = &domainSummary{Domain: d}
+			byDomain[d] = s
+		}
+		s.Count++
+		s.DurationMs += float64(e.Duration) / float64(time.Millisecond)
+		if e.TransferSize > 0 {
+			s.TotalBytes += e.TransferSize
+		}
+	}
+	summaries := make([]domainSummary, 0, len(byDomain))
+	for _, s := range byDomain {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].DurationMs != summaries[j].DurationMs {
+			return summaries[i].DurationMs > summaries[j].DurationMs
+		}
+		return summaries[i].Domain < summaries[j].Domain
+	})
+	return summaries
+}
+
+// resourceDomain returns the host (without port) of the resource URL u, or
+// invalidDomain if u isn't an absolute URL.
+func resourceDomain(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Hostname() == "" {
+		return invalidDomain
+	}
+	return parsed.Hostname()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestDomains(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	trace := ingest(t, a, `{"v": 1, "entries": [
+		{"name": "https://example.com/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "https://example.com/a.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 40, "transferSize": 1000},
+		{"name": "https://example.com:8443/b.css", "entryType": "resource", "startOffsetMs": 10, "durationMs": 30, "transferSize": 500},
+		{"name": "https://cdn.example.net/lib.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 200, "transferSize": 3000},
+		{"name": "https://ads.example.org/ad.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 50},
+		{"name": "https://ads.example.org/pixel.gif", "entryType": "resource", "startOffsetMs": 10, "durationMs": 25, "transferSize": 43},
+		{"name": "::not a url", "entryType": "resource", "startOffsetMs": 10, "durationMs": 5}
+	]}`)
+
+	w := get(a.Domains, "/domains?trace="+trace)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got []domainSummary
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// Ports don't make another domain, and sizes hidden from the page
+	// (transferSize 0) don't count.
+	want := []domainSummary{
+		{Domain: "cdn.example.net", Count: 1, DurationMs: 200, TotalBytes: 3000},
+		{Domain: "ads.example.org", Count: 2, DurationMs: 75, TotalBytes: 43},
+		{Domain: "example.com", Count: 2, DurationMs: 70, TotalBytes: 1500},
+		{Domain: invalidDomain, Count: 1, DurationMs: 5},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d domains, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+
+	for target, code := range map[string]int{
+		"/domains?trace=xyz":              http.StatusBadRequest,
+		"/domains?trace=0123456789abcdef": http.StatusNotFound,
+	} {
+		if w := get(a.Domains, target); w.Code != code {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+func TestResourceDomain(t *testing.T) {
+	for u, want := range map[string]string{
+		"https://example.com:8443/a.js": "example.com",
+		"http://[::1]:8699/":            "::1",
+		"/relative/a.js":                invalidDomain,
+		"%zz":                           invalidDomain,
+	} {
+		if got := resourceDomain(u); got != want {
+			t.Errorf("%q: got %q, want %q", u, got, want)
+		}
+	}
+}
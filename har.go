@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// The types below are the subset of HAR 1.2 (see
+// http://www.softwareishard.com/blog/har-12-spec/) we can reconstruct from
+// the Resource Timing data of a trace. Fields the browser doesn't expose to
+// the page, such as headers and cookies, are left empty.
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // ms
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string   `json:"method"`
+	URL         string   `json:"url"`
+	HTTPVersion string   `json:"httpVersion"`
+	Cookies     []harNVP `json:"cookies"`
+	Headers     []harNVP `json:"headers"`
+	QueryString []harNVP `json:"queryString"`
+	HeadersSize int64    `json:"headersSize"`
+	BodySize    int64    `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNVP   `json:"cookies"`
+	Headers     []harNVP   `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int64      `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harNVP struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings holds the phases of a fetch in milliseconds; -1 marks a phase
+// which doesn't apply or wasn't reported, as the HAR spec requires.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HAR serves the resources of the trace given by the trace query parameter
+// as a HAR file, for use with the HAR tooling frontend engineers know.
+func (a *App) HAR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	id, err := appdash.ParseID(r.URL.Query().Get("trace"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid trace ID", err.Error())
+		return
+	}
+	trace, err := a.findTrace(id)
+	if err != nil {
+		slog.Error("querying traces", "handler", "har", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+	if trace == nil {
+		writeJSONError(w, http.StatusNotFound, "trace not found", id.String())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.har"`, id))
+	json.NewEncoder(w).Encode(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "loadtimes", Version: "1.0"},
+		Entries: harEntries(trace),
+	}})
+}
+
+// findTrace returns the stored trace with the given ID, or nil if there is
+// none.
+func (a *App) findTrace(id appdash.ID) (*appdash.Trace, error) {
+	traces, err := a.Queryer.Traces()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range traces {
+		if t.Span.ID.Trace == id {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// harEntries returns a HAR entry for every resource recorded in t, in the
+// order they were fetched.
+func harEntries(t *appdash.Trace) []harEntry {
+	entries := []harEntry{}
+	var walk func(t *appdash.Trace)
+	walk = func(t *appdash.Trace) {
+		var e ResourceEvent
+		if err := appdash.UnmarshalEvent(t.Span.Annotations, &e); err == nil {
+			entries = append(entries, newHAREntry(e, t.Sub))
+			return
+		}
+		for _, sub := range t.Sub {
+			walk(sub)
+		}
+	}
+	walk(t)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	return entries
+}
+
+// newHAREntry returns the HAR entry of the resource e, taking its timings
+// from the phase spans recorded under it.
+func newHAREntry(e ResourceEvent, phases []*appdash.Trace) harEntry {
+	byName := make(map[string]float64, len(phases))
+	for _, p := range phases {
+		var ts appdash.Timespan
+		if err := appdash.UnmarshalEvent(p.Span.Annotations, &ts); err == nil {
+			byName[p.Span.Name()] = float64(ts.End().Sub(ts.Start())) / float64(time.Millisecond)
+		}
+	}
+	phase := func(name string) float64 {
+		if d, ok := byName[name]; ok {
+			return d
+		}
+		return -1
+	}
+	timings := harTimings{
+		Blocked: -1,
+		DNS:     phase("DNS"),
+		Connect: phase("TCP"), // includes SSL, as in HAR
+		SSL:     phase("TLS"),
+		Wait:    phase("TTFB"),
+		Receive: phase("Content Download"),
+	}
+	// send, wait and receive are required to be non-negative.
+	if timings.Wait < 0 {
+		timings.Wait = 0
+	}
+	if timings.Receive < 0 {
+		timings.Receive = 0
+	}
+
+	content := e.DecodedBodySize
+	if content < 0 {
+		content = 0
+	}
+	return harEntry{
+		StartedDateTime: e.FetchStart,
+		Time:            float64(e.Duration) / float64(time.Millisecond),
+		Request: harRequest{
+			Method:      "GET",
+			URL:         e.URL,
+			HTTPVersion: e.Protocol,
+			Cookies:     []harNVP{},
+			Headers:     []harNVP{},
+			QueryString: []harNVP{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      e.Status, // 0 if unknown, as HAR allows
+			HTTPVersion: e.Protocol,
+			Cookies:     []harNVP{},
+			Headers:     []harNVP{},
+			Content:     harContent{Size: content},
+			HeadersSize: -1,
+			BodySize:    e.EncodedBodySize,
+		},
+		Timings: timings,
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// newStoreApp returns an App recording into, and querying, a MemoryStore.
+func newStoreApp(cfg Config) (*App, *appdash.MemoryStore) {
+	ms := appdash.NewMemoryStore()
+	a, _ := newTestApp(cfg)
+	a.Collector, a.Queryer = ms, ms
+	return a, ms
+}
+
+// ingest posts body to a's Endpoint and returns the ID of the trace it was
+// recorded into.
+func ingest(t *testing.T, a *App, body string) string {
+	t.Helper()
+	w := postPayload(a, "/endpoint", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp endpointResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Trace
+}
+
+// get requests target from handler h and returns the response.
+func get(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func TestHAR(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	trace := ingest(t, a, testPayload)
+	w := get(a.HAR, "/har?trace="+trace)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// Check against the fields the HAR 1.2 schema requires, on the generic
+	// JSON rather than our own types.
+	var har struct {
+		Log struct {
+			Version string                       `json:"version"`
+			Creator map[string]any               `json:"creator"`
+			Entries []map[string]json.RawMessage `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || har.Log.Creator["name"] == nil || har.Log.Creator["version"] == nil {
+		t.Errorf("got log version %q, creator %v", har.Log.Version, har.Log.Creator)
+	}
+	if len(har.Log.Entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(har.Log.Entries))
+	}
+	required := map[string][]string{
+		"request":  {"method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize"},
+		"response": {"status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize"},
+		"timings":  {"send", "wait", "receive"},
+	}
+	entries := make(map[string]harEntry)
+	for i, raw := range har.Log.Entries {
+		for _, k := range []string{"startedDateTime", "time", "request", "response", "cache", "timings"} {
+			if _, ok := raw[k]; !ok {
+				t.Errorf("entry %d: missing %s", i, k)
+			}
+		}
+		for obj, keys := range required {
+			var m map[string]json.RawMessage
+			json.Unmarshal(raw[obj], &m)
+			for _, k := range keys {
+				if _, ok := m[k]; !ok {
+					t.Errorf("entry %d: missing %s.%s", i, obj, k)
+				}
+			}
+		}
+		b, _ := json.Marshal(raw)
+		var e harEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Fatal(err)
+		}
+		entries[e.Request.URL] = e
+		tm := e.Timings
+		if tm.Send < 0 || tm.Wait < 0 || tm.Receive < 0 {
+			t.Errorf("%s: got negative send, wait or receive in %+v", e.Request.URL, tm)
+		}
+		for _, v := range []float64{tm.Blocked, tm.DNS, tm.Connect, tm.SSL} {
+			if v < 0 && v != -1 {
+				t.Errorf("%s: got timing %v, want -1 if unknown", e.Request.URL, v)
+			}
+		}
+	}
+
+	js := entries["https://cdn.example.com/app.js"]
+	for name, tt := range map[string]struct{ got, want float64 }{
+		"blocked":      {js.Timings.Blocked, -1},
+		"dns":          {js.Timings.DNS, 9.75},
+		"connect":      {js.Timings.Connect, 30},
+		"ssl":          {js.Timings.SSL, 20},
+		"wait":         {js.Timings.Wait, 29.5},
+		"receive":      {js.Timings.Receive, 25.75},
+		"time":         {js.Time, 95.5},
+		"content.size": {float64(js.Response.Content.Size), 61000},
+		"bodySize":     {float64(js.Response.BodySize), 20000},
+		"status":       {float64(js.Response.Status), 200},
+	} {
+		if math.Abs(tt.got-tt.want) > 1e-6 {
+			t.Errorf("app.js %s: got %v, want %v", name, tt.got, tt.want)
+		}
+	}
+	// The phases of the cross-origin font are hidden.
+	font := entries["https://fonts.example.net/font.woff2"]
+	if tm := font.Timings; tm.DNS != -1 || tm.Connect != -1 || tm.SSL != -1 {
+		t.Errorf("font: got timings %+v, want the phases unknown", tm)
+	}
+
+	for target, code := range map[string]int{
+		"/har?trace=nope":             http.StatusBadRequest,
+		"/har?trace=0123456789abcdef": http.StatusNotFound,
+	} {
+		if w := get(a.HAR, target); w.Code != code {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, code)
+		}
+	}
+}
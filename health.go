@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// Healthz is the liveness probe: it always reports ok while the process is
+// serving requests.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// Readyz is the readiness probe: it reports ok while a.ReadyCheck passes,
+// and 503 Service Unavailable while it fails. The store is loaded before the
+// app is served at all (see startEmbedded). Probes are served outside of the
+// tracing middleware.
+//
+// Readyz also reports how many times Endpoint failed to record spans, and
+// the last error, if any. Those don't make the app unready: a store or
+// remote collector may well recover, which it can't be seen to do if no
+// more beacons are sent our way.
+func (a *App) Readyz(w http.ResponseWriter, r *http.Request) {
+	if a.ReadyCheck != nil {
+		if err := a.ReadyCheck(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprint(w, "ok")
+	if a.CollectStatus == nil {
+		return
+	}
+	if failures, err, at := a.CollectStatus.snapshot(); failures > 0 {
+		fmt.Fprintf(w, "\ncollect failures: %d\nlast collect error: %s (at %s)", failures, err, at.Format(time.RFC3339))
+	}
+}
+
+// readyDialTimeout is how long dialCheck waits for a connection.
+const readyDialTimeout = time.Second
+
+// dialCheck returns a ReadyCheck which fails unless each of addrs (a listen
+// address such as -ui-addr, or the address of a remote collector) accepts
+// TCP connections.
+func dialCheck(addrs ...string) func() error {
+	return func() error {
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout("tcp", addr, readyDialTimeout)
+			if err != nil {
+				return err
+			}
+			conn.Close()
+		}
+		return nil
+	}
+}
+
+// collectStatus keeps track of the errors Endpoint got recording spans.
+type collectStatus struct {
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+	lastAt   time.Time
+}
+
+// failed records that recording spans failed with err at now.
+func (s *collectStatus) failed(err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	s.lastErr, s.lastAt = err, now
+}
+
+// snapshot returns the number of failures so far, and the last error and
+// when it happened.
+func (s *collectStatus) snapshot() (failures int, lastErr error, lastAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures, s.lastErr, s.lastAt
+}
+
+// statusCollector is an appdash.Collector which passes spans on to
+// Collector, counting the flushes it fails in Status and in the
+// collect_errors_total metric. It goes inside an appdash.ChunkedCollector,
+// whose flushes happen in the background, after Endpoint has replied: their
+// errors would otherwise only be logged.
+//
+// A flush collects each of the spans buffered since the last one, and fails
+// them all alike when the store is full or the remote collector down; it is
+// counted once however many of its spans failed. OnFlush must be called as
+// each flush starts (see appdash.ChunkedCollector.OnFlush).
+type statusCollector struct {
+	appdash.Collector
+	Status *collectStatus
+
+	mu     sync.Mutex
+	failed bool // whether the current flush has failed already
+}
+
+// OnFlush marks the start of a flush.
+func (c *statusCollector) OnFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = false
+}
+
+// Collect implements the appdash.Collector interface.
+func (c *statusCollector) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	err := c.Collector.Collect(id, as...)
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	first := !c.failed
+	c.failed = true
+	c.mu.Unlock()
+	if first {
+		collectErrors.Inc()
+		c.Status.failed(err, time.Now())
+	}
+	return err
+}
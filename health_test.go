@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+func TestHealthz(t *testing.T) {
+	if w := get(Healthz, "/healthz"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("got %d %q, want 200 ok", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	a, _ := newTestApp(Config{})
+	if w := get(a.Readyz, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("no check: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	a.ReadyCheck = func() error { return errors.New("web UI down") }
+	w := get(a.Readyz, "/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "web UI down") {
+		t.Errorf("failing check: got %d %q, want 503 with the error", w.Code, w.Body)
+	}
+
+	// Failures to record spans are reported, but don't make the app
+	// unready.
+	a.ReadyCheck = nil
+	a.CollectStatus.failed(errors.New("store full"), time.Now())
+	w = get(a.Readyz, "/readyz")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "collect failures: 1") || !strings.Contains(w.Body.String(), "store full") {
+		t.Errorf("collect failures: got %d %q, want 200 with the failures", w.Code, w.Body)
+	}
+}
+
+func TestDialCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := dialCheck(l.Addr().String())
+	if err := check(); err != nil {
+		t.Errorf("listening: got error %v", err)
+	}
+
+	a, _ := newTestApp(Config{})
+	a.ReadyCheck = check
+	if w := get(a.Readyz, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("listening: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	l.Close()
+	if w := get(a.Readyz, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("closed: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestStatusCollector(t *testing.T) {
+	errs := testutil.ToFloat64(collectErrors)
+	a, _ := newTestApp(Config{})
+	status := &collectStatus{}
+	a.CollectStatus = status
+
+	// The store fails, but only once the buffered spans are flushed, after
+	// Endpoint has replied.
+	sc := &statusCollector{Collector: &captureCollector{err: errors.New("store full")}, Status: status}
+	chunked := appdash.NewChunkedCollector(sc)
+	chunked.MinInterval = time.Hour
+	chunked.OnFlush = func(int) { sc.OnFlush() }
+	defer chunked.Stop()
+	a.Collector = chunked
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if failures, _, _ := status.snapshot(); failures != 0 {
+		t.Fatalf("got %d failures before the flush, want none", failures)
+	}
+	if err := chunked.Flush(); err == nil {
+		t.Fatal("flush: got no error")
+	}
+
+	// Every span of the flush failed, which counts as one failure.
+	failures, err, _ := status.snapshot()
+	if failures != 1 || err == nil || err.Error() != "store full" {
+		t.Errorf("got %d failures, last %v, want 1 with the store's error", failures, err)
+	}
+	if got := testutil.ToFloat64(collectErrors) - errs; got != 1 {
+		t.Errorf("got %v more collect errors, want 1", got)
+	}
+
+	// As does the next flush.
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	chunked.Flush()
+	if failures, _, _ := status.snapshot(); failures != 2 {
+		t.Errorf("after a second flush: got %d failures, want 2", failures)
+	}
+	if w := get(a.Readyz, "/readyz"); !strings.Contains(w.Body.String(), "store full") {
+		t.Errorf("readyz: got %q, want the flush error", w.Body)
+	}
+}
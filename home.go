@@ -0,0 +1,152 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// demoStylesheet is a stylesheet of the demo page, loaded for the page to have
+// resources worth timing.
+type demoStylesheet struct {
+	URL   string
+	Media string
+}
+
+// demoAssets are the resources the demo page served by Home loads.
+type demoAssets struct {
+	Stylesheets []demoStylesheet
+	Scripts     []string // in load order; jQuery, which the page's script needs, last
+	Images      []string
+}
+
+// defaultDemoAssets are the resources the demo page has always loaded: a
+// typical storefront's stylesheets and scripts, and an image.
+var defaultDemoAssets = demoAssets{
+	Stylesheets: []demoStylesheet{
+		{"https://bedbathandbeyond.qa.nrdecor.com/js/lib/jqwidgets/styles/jqx.base.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/js/lib/jqwidgets/styles/jqx.office.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/js/lib/justified-gallery/styles/justifiedGallery.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/styles.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/widgets.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/common/css/common.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/common/css/jquery-ui-1.9.2.custom.min.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/web/css/web.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/web/css/fonts.css", "all"},
+		{"https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/print.css", "print"},
+	},
+	Scripts: []string{
+		"https://bedbathandbeyond.qa.nrdecor.com/js/prototype/prototype.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/lib/ccard.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/prototype/validation.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/builder.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/effects.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/dragdrop.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/controls.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/slider.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/varien/js.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/varien/form.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/varien/menu.js",
+		"https://bedbathandbeyond.qa.nrdecor.com/js/mage/translate.js",
+		"https://cdnjs.cloudflare.com/ajax/libs/jquery/3.0.0-alpha1/jquery.min.js",
+	},
+	Images: []string{
+		"http://flex.madebymufffin.com/images/inacup_donut.jpg",
+	},
+}
+
+// clientScript is the script which posts a page's timings to Endpoint, as
+// served by ClientScript.
+//
+//go:embed loadPerformanceData.js
+var clientScript []byte
+
+// ClientScript serves the script which posts a page's timings to Endpoint,
+// for the demo page and any other page to include.
+func ClientScript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Write(clientScript)
+}
+
+// beaconFlushInterval is how often the demo page posts the resources which
+// finished loading since its last post.
+const beaconFlushInterval = 5 * time.Second
+
+// homeData is what homeTemplate renders.
+type homeData struct {
+	Endpoint    string // where the page posts its timings
+	PageTraceID string // the span which served the page, posted with its timings
+	FlushMs     int64  // how often the page posts new resources, in ms
+	TraceURL    string // the trace of this page in the web UI
+	TracesURL   string // all the traces in the web UI
+	Assets      demoAssets
+}
+
+// endpointURL returns the URL pages post their timings to: -endpoint-url, or
+// this app's /endpoint.
+func (a *App) endpointURL() string {
+	if a.EndpointURL == "" {
+		return "/endpoint"
+	}
+	return a.EndpointURL
+}
+
+// checkEndpointURL checks that s, the -endpoint-url, is a URL pages can post
+// to: an absolute http(s) URL, or a path on this app. Empty means the
+// default.
+func checkEndpointURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Host == "" {
+			return errors.New("missing host")
+		}
+	case u.Scheme != "":
+		return errors.New("must be http or https")
+	case u.Host != "" || !strings.HasPrefix(u.Path, "/"):
+		return errors.New("must be an absolute URL or path")
+	}
+	return nil
+}
+
+// homeTemplate is the demo page served by Home. It loads the client script
+// (see ClientScript), configured to post the page's timings to the Endpoint
+// under the trace of the request which served it.
+var homeTemplate = template.Must(template.New("home").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Test load</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+{{range .Assets.Stylesheets}}  <link rel="stylesheet" type="text/css" href="{{.URL}}" media="{{.Media}}">
+{{end}}{{range .Assets.Scripts}}  <script type="text/javascript" src="{{.}}"></script>
+{{end}}
+  <script type="text/javascript">
+    window.loadtimesEndpoint = {{.Endpoint}};
+    window.loadtimesTraceID = {{.PageTraceID}};
+    window.loadtimesFlushMs = {{.FlushMs}};
+  </script>
+  <script type="text/javascript" src="/loadPerformanceData.js"></script>
+</head>
+<body>
+{{range .Assets.Images}}  <img src="{{.}}" alt="Smiley face" height="42" width="42">
+{{end}}  <p><a href="{{.TraceURL}}" target="_">View this page's trace</a> (or <a href="{{.TracesURL}}" target="_">all traces</a>)</p>
+</body>
+</html>
+`))
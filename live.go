@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveWriteTimeout is how long Live waits for a client to take a message
+// before dropping it as too slow to keep up.
+const liveWriteTimeout = 10 * time.Second
+
+// Live streams each resource Endpoint records to the client over a
+// WebSocket, as a JSON resourceSummary per message, e.g. to watch a load
+// test as it runs. Pages on the origins allowed by -cors-origin may connect
+// to it. Clients are only meant to listen; anything they send is discarded.
+func (a *App) Live(w http.ResponseWriter, r *http.Request) {
+	ch, ok := a.Broadcaster.subscribe()
+	if !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, "too many subscribers", fmt.Sprintf("limit is %d", maxStreamSubscribers))
+		return
+	}
+	defer a.Broadcaster.unsubscribe(ch)
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || sameOrigin(r, origin) {
+				return true
+			}
+			_, ok := a.corsAllowOrigin(origin)
+			return ok
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has replied with an error already
+	}
+	defer conn.Close()
+
+	// Read (and discard) whatever the client sends, so that its close
+	// message and pings are handled, and notice when it goes away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-a.Broadcaster.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return
+			}
+		case s := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			for _, e := range s.Entries {
+				if err := conn.WriteJSON(e); err != nil {
+					slog.Warn("dropping live client", "remote_addr", r.RemoteAddr, "error", err)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLive(t *testing.T) {
+	a, _ := newTestApp(Config{CORSOrigin: "https://example.com"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", a.Live)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer a.Broadcaster.close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/live"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The connection is subscribed once it is upgraded.
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	got := make(map[string]resourceSummary)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < 3 {
+		var rs resourceSummary
+		if err := conn.ReadJSON(&rs); err != nil {
+			t.Fatalf("after %d messages: %s", len(got), err)
+		}
+		got[rs.Name] = rs
+	}
+	if rs := got["https://cdn.example.com/app.js"]; rs.DurationMs != 95.5 || rs.InitiatorType != "script" {
+		t.Errorf("got %+v, want a 95.5ms script", rs)
+	}
+	for _, name := range []string{"http://localhost:8699/style.css", "https://fonts.example.net/font.woff2"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s not received", name)
+		}
+	}
+
+	// The app's own pages may connect too, without -cors-origin listing them.
+	sameConn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Errorf("same origin: %s", err)
+	} else {
+		sameConn.Close()
+	}
+
+	// Pages on other origins may not connect.
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.net"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other origin: got %v, want a 403", err)
+	}
+}
+
+func TestBroadcasterDropsSlowSubscribers(t *testing.T) {
+	b := newBroadcaster()
+	slow, _ := b.subscribe()
+	fast, _ := b.subscribe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b.publish(batchSummary{Resources: i})
+			<-fast
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a subscriber not reading")
+	}
+	// The slow subscriber got what fit in its buffer, the rest it missed.
+	if n := len(slow); n != cap(slow) {
+		t.Errorf("slow subscriber has %d summaries queued, want %d", n, cap(slow))
+	}
+}
@@ -1,30 +1,206 @@
+// loadPerformanceData.js posts the page's Resource, Navigation and Paint
+// Timing entries and its Core Web Vitals to a loadtimes server. Include it
+// from the server (e.g. <script src="https://rum.example.com/loadPerformanceData.js">)
+// after jQuery. By default it posts to the /endpoint of the server it was
+// loaded from; a page may set before it:
+//
+//   window.loadtimesEndpoint: the URL to post to instead
+//   window.loadtimesTraceID:  the span of the request which served the page,
+//                             for the page load to be nested under its trace
+//   window.loadtimesFlushMs:  how often to post new resources, in ms
+var loadtimesScript = document.currentScript;
+
 $(document).ready(function () {
-var arr = window.performance.getEntriesByType("resource")
-jsonObj = [];
-console.log(jsonObj);
-  $.each( arr, function( i, val ) {
-      var name = val.name;
-      var entryType = val.entryType;
-      var startTime = val.fetchStart;
-      var endTime = val.duration;
-      var initiatorType = val.initiatorType;
-
-      item = {}
-      item ["name"] = name;
-      item ["entryType"] = entryType;
-      item ["startTime"] = startTime;
-      item ["endTime"] = endTime;
-      item ["initiatorType"] = initiatorType;
-
-      jsonObj.push(item);
-   });
-   jsonString = JSON.stringify(jsonObj);
-   console.log(jsonString);
-   $.ajax({
-       type: "POST",
-       url: "http://localhost:8699/endpoint",
-       data: jsonString
-       // success: success,
-       // dataType: dataType
-     });
+  // Every batch posted by this page load carries the same session ID, so the
+  // server records them all into one trace.
+  var sessionId = Date.now().toString(36) + Math.random().toString(36).slice(2);
+  var endpoint = window.loadtimesEndpoint ||
+      (loadtimesScript && loadtimesScript.src ? new URL("/endpoint", loadtimesScript.src).href : "/endpoint");
+  var flushMs = window.loadtimesFlushMs || 5000;
+
+  function toItem(val) {
+      var item = {};
+      // Largest Contentful Paint entries have no name.
+      item ["name"] = val.name || val.entryType;
+      item ["entryType"] = val.entryType;
+      // Paint entries have no fetchStart; they happen at their startTime.
+      item ["startOffsetMs"] = "fetchStart" in val ? val.fetchStart : val.startTime;
+      item ["durationMs"] = val.duration;
+      item ["initiatorType"] = val.initiatorType;
+      item ["protocol"] = val.nextHopProtocol;
+      item ["redirectStart"] = val.redirectStart;
+      item ["redirectEnd"] = val.redirectEnd;
+      item ["domainLookupStart"] = val.domainLookupStart;
+      item ["domainLookupEnd"] = val.domainLookupEnd;
+      item ["connectStart"] = val.connectStart;
+      item ["connectEnd"] = val.connectEnd;
+      item ["secureConnectionStart"] = val.secureConnectionStart;
+      item ["requestStart"] = val.requestStart;
+      item ["responseStart"] = val.responseStart;
+      item ["responseEnd"] = val.responseEnd;
+      item ["transferSize"] = val.transferSize;
+      item ["encodedBodySize"] = val.encodedBodySize;
+      item ["decodedBodySize"] = val.decodedBodySize;
+      item ["status"] = val.responseStatus || 0;
+      item ["serverTiming"] = (val.serverTiming || []).map(function (m) {
+          return {name: m.name, duration: m.duration, description: m.description};
+      });
+      // Navigation Timing milestones, only set on the navigation entry.
+      item ["domInteractive"] = val.domInteractive;
+      item ["domContentLoadedEventStart"] = val.domContentLoadedEventStart;
+      item ["domContentLoadedEventEnd"] = val.domContentLoadedEventEnd;
+      item ["domComplete"] = val.domComplete;
+      item ["loadEventEnd"] = val.loadEventEnd;
+      // The largest element painted, only set on the largest-contentful-paint
+      // entry.
+      if (val.element) {
+          item ["element"] = val.element.tagName.toLowerCase() + (val.element.id ? "#" + val.element.id : "");
+      }
+      item ["url"] = val.url;
+      // The score of a layout-shift entry.
+      item ["value"] = val.value;
+      return item;
+  }
+
+  // send posts entries, with the fields describing the page once for all of
+  // them.
+  function send(entries) {
+      if (entries.length == 0) {
+          return;
+      }
+      var payload = {
+          v: 1,
+          sessionId: sessionId,
+          pageUrl: location.href,
+          pagePath: location.pathname,
+          userAgent: navigator.userAgent,
+          // Lets the server place the page's time origin, which all the
+          // entries' timings are relative to.
+          sentAtMs: performance.now(),
+          entries: $.map(entries, toItem)
+      };
+      if (window.loadtimesTraceID) {
+          payload.pageTraceId = window.loadtimesTraceID;
+      }
+      var body = JSON.stringify(payload);
+      if (!navigator.sendBeacon) {
+          post(body);
+          return;
+      }
+      if (navigator.sendBeacon(endpoint, body)) {
+          return;
+      }
+      // sendBeacon refuses a body over its quota (about 64KB, shared by the
+      // page's beacons still in flight), so a large batch is sent in halves,
+      // down to single entries which fetch is left to try.
+      if (entries.length > 1) {
+          var half = Math.ceil(entries.length / 2);
+          send(entries.slice(0, half));
+          send(entries.slice(half));
+      } else {
+          post(body);
+      }
+  }
+
+  // post sends body with fetch, which like sendBeacon outlives the page when
+  // keepalive is set.
+  function post(body) {
+      fetch(endpoint, {method: "POST", body: body, keepalive: true}).catch(function () {});
+  }
+
+  // The navigation entry is only complete once the load event has finished.
+  function sendNavigation() {
+      setTimeout(function () {
+          // The paint entries, if the browser reports them, go along.
+          send(window.performance.getEntriesByType("navigation")
+              .concat(window.performance.getEntriesByType("paint")));
+      }, 0);
+  }
+  if (document.readyState == "complete") {
+      sendNavigation();
+  } else {
+      $(window).on("load", sendNavigation);
+  }
+
+  if (window.PerformanceObserver) {
+      // Collect resources as they finish loading, so lazy-loaded images, XHRs
+      // and anything added after load are captured too, and post them in
+      // batches every flushMs and when the page is hidden or goes away.
+      // buffered: true replays the entries recorded before the observer was
+      // registered.
+      var pending = [];
+      var flush = function () {
+          var entries = pending;
+          pending = [];
+          send(entries);
+      };
+      new PerformanceObserver(function (list) {
+          pending = pending.concat(list.getEntries());
+      }).observe({type: "resource", buffered: true});
+      setInterval(flush, flushMs);
+      // Pages hidden on mobile may be discarded without a pagehide, so
+      // flush when they are hidden too. send uses navigator.sendBeacon,
+      // which still delivers while the page is going away.
+      $(window).on("pagehide", flush);
+      $(document).on("visibilitychange", function () {
+          if (document.visibilityState == "hidden") {
+              flush();
+          }
+      });
+  } else {
+      send(window.performance.getEntriesByType("resource"));
+  }
+
+  // The Core Web Vitals change as the page renders and the user interacts
+  // with it, so their final values are posted once the page is first hidden.
+  var supportedEntryTypes = (window.PerformanceObserver && PerformanceObserver.supportedEntryTypes) || [];
+
+  // Largest Contentful Paint: the last candidate reported.
+  var lcp = null;
+  if (supportedEntryTypes.indexOf("largest-contentful-paint") >= 0) {
+      new PerformanceObserver(function (list) {
+          var entries = list.getEntries();
+          lcp = entries[entries.length - 1];
+      }).observe({type: "largest-contentful-paint", buffered: true});
+  }
+
+  // Cumulative Layout Shift: the largest sum of the shifts not caused by user
+  // input within a session window, i.e. shifts less than 1s apart spanning at
+  // most 5s.
+  var cls = null, clsWindow = 0, clsWindowStart = 0, clsWindowEnd = 0;
+  if (supportedEntryTypes.indexOf("layout-shift") >= 0) {
+      cls = 0;
+      new PerformanceObserver(function (list) {
+          $.each(list.getEntries(), function (i, e) {
+              if (e.hadRecentInput) {
+                  return;
+              }
+              if (clsWindow > 0 && e.startTime - clsWindowEnd < 1000 && e.startTime - clsWindowStart < 5000) {
+                  clsWindow += e.value;
+              } else {
+                  clsWindow = e.value;
+                  clsWindowStart = e.startTime;
+              }
+              clsWindowEnd = e.startTime;
+              cls = Math.max(cls, clsWindow);
+          });
+      }).observe({type: "layout-shift", buffered: true});
+  }
+
+  var vitalsSent = false;
+  $(document).on("visibilitychange", function () {
+      if (document.visibilityState != "hidden" || vitalsSent) {
+          return;
+      }
+      vitalsSent = true;
+      var entries = [];
+      if (lcp) {
+          entries.push(lcp);
+      }
+      // A score of 0 is still sent, to tell it apart from no score at all.
+      if (cls !== null) {
+          entries.push({name: "layout-shift", entryType: "layout-shift", startTime: clsWindowEnd, duration: 0, value: cls});
+      }
+      send(entries);
+  });
 });
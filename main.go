@@ -6,10 +6,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"sourcegraph.com/sourcegraph/appdash"
@@ -17,8 +36,9 @@ import (
 	"sourcegraph.com/sourcegraph/appdash/traceapp"
 
 	"github.com/codegangsta/negroni"
-	"github.com/gorilla/context"
+	gcontext "github.com/gorilla/context"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Used to  store the CtxSpanID in a request's context (see gorilla/context docs
@@ -27,111 +47,875 @@ const CtxSpanID = 0
 
 // ClientCallInfo to fetch the values
 type ClientCallInfo struct {
+	// SessionID identifies the page load the entry was posted by, which
+	// generates it once and sends it with each entry of each of its
+	// beacons. See sessionRegistry.
+	SessionID string `json:"sessionId"`
+
+	// PageTraceID is the span of the request which served the page (as
+	// formatted by appdash.SpanID.String), if known, so that the page load
+	// is recorded under that request's trace rather than as a trace of its
+	// own.
+	PageTraceID string `json:"pageTraceId"`
+
+	// PageURL (location.href) and UserAgent (navigator.userAgent) describe
+	// the page which posted the entry and the browser which loaded it.
+	// PagePath is the path of PageURL (location.pathname).
+	PageURL   string
+	PagePath  string
+	UserAgent string
+
+	// SentAtMs is when the entry's payload was sent (performance.now()),
+	// in milliseconds relative to the page's time origin. Subtracted from
+	// the time the payload is received, it places the page's time origin.
+	SentAtMs *float64 `json:"sentAtMs"`
+
 	Name          string
 	EntryType     string
-	StartTime     float64
-	EndTime       float64
 	InitiatorType string
+
+	// StartOffsetMs is when the fetch started (fetchStart), in milliseconds
+	// relative to the page's time origin, and DurationMs how long it took
+	// from there to the end of the response (duration). DurationMs is a
+	// length of time, not a point in time. Every entry must carry both (see
+	// validateClientCalls); they are pointers so that a missing one isn't
+	// mistaken for 0. nullTimings is set if either was null, which is what
+	// JSON.stringify turns NaN and infinite numbers into.
+	StartOffsetMs *float64
+	DurationMs    *float64
+	nullTimings   bool
+
+	// Protocol is the network protocol the resource was fetched over
+	// (nextHopProtocol, e.g. "http/1.1", "h2" or "h3"). It is empty for
+	// cross-origin resources served without Timing-Allow-Origin.
+	Protocol string
+
+	// Resource Timing milestones, in milliseconds relative to the page's
+	// time origin (the same clock as StartOffsetMs). A milestone the browser did
+	// not report is 0.
+	RedirectStart         float64
+	RedirectEnd           float64
+	DomainLookupStart     float64
+	DomainLookupEnd       float64
+	ConnectStart          float64
+	ConnectEnd            float64
+	SecureConnectionStart float64
+	RequestStart          float64
+	ResponseStart         float64
+	ResponseEnd           float64
+
+	// Status is the HTTP status code of the resource's response
+	// (responseStatus), or 0 if the browser doesn't report it, e.g. for
+	// cross-origin resources served without CORS or in browsers without
+	// responseStatus. It isn't taken to be 200 then, so that a 404 the
+	// browser didn't report can't pass for a success in the HAR export.
+	Status int
+
+	// Sizes in bytes, as reported by the browser. Cross-origin resources
+	// served without Timing-Allow-Origin report 0 for all of them.
+	TransferSize    float64
+	EncodedBodySize float64
+	DecodedBodySize float64
+
+	// ServerTiming holds the metrics of the Server-Timing header of the
+	// resource's response (e.g. db, cache, render), if it had one.
+	ServerTiming []ServerTimingMetric
+
+	// Element describes the element of a "largest-contentful-paint" entry
+	// (its tag name, and #id if it has one), and URL is the image it
+	// painted, if any.
+	Element string
+	URL     string
+
+	// Value is the score of a "layout-shift" entry: the page's cumulative
+	// layout shift, as computed by the client script.
+	Value float64
+
+	NavigationInfo
+}
+
+// ServerTimingMetric is one metric of a Server-Timing header, as exposed by
+// the browser. Duration is in milliseconds.
+type ServerTimingMetric struct {
+	Name        string
+	Duration    float64
+	Description string
 }
 
-// NewServerEvent returns an event which records various aspects of an
-// HTTP response. It takes an HTTP request, not response, as input
-// because the information it records is derived from the request, and
-// HTTP handlers don't have access to the response struct (only
-// http.ResponseWriter, which requires wrapping or buffering to
-// introspect).
+// NavigationInfo holds the Navigation Timing milestones of the page itself,
+// in milliseconds relative to the page's time origin. They are only set on
+// the entry whose EntryType is "navigation".
+type NavigationInfo struct {
+	DomInteractive             float64
+	DomContentLoadedEventStart float64
+	DomContentLoadedEventEnd   float64
+	DomComplete                float64
+	LoadEventEnd               float64
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, telling an offset
+// or duration which is null (see nullTimings) from one which is missing.
+func (c *ClientCallInfo) UnmarshalJSON(b []byte) error {
+	type plain ClientCallInfo // without this method
+	if err := json.Unmarshal(b, (*plain)(c)); err != nil {
+		return err
+	}
+	var raw struct{ StartOffsetMs, DurationMs json.RawMessage }
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	c.nullTimings = string(raw.StartOffsetMs) == "null" || string(raw.DurationMs) == "null"
+	return nil
+}
+
+// startMs returns StartOffsetMs, or 0 if the entry has none.
+func (c ClientCallInfo) startMs() float64 {
+	if c.StartOffsetMs == nil {
+		return 0
+	}
+	return *c.StartOffsetMs
+}
+
+// durationMs returns DurationMs, or 0 if the entry has none.
+func (c ClientCallInfo) durationMs() float64 {
+	if c.DurationMs == nil {
+		return 0
+	}
+	return *c.DurationMs
+}
+
+// cachedMaxDuration is the longest a resource whose size is hidden from us
+// (see fromCache) may take to load, in milliseconds, to still be considered
+// served from the browser cache.
+const cachedMaxDuration = 2.0
+
+// fromCache reports whether the resource was most likely served from the
+// browser (or HTTP) cache rather than fetched over the network: nothing was
+// transferred for it, yet it has a body. Cross-origin resources served
+// without Timing-Allow-Origin report no sizes at all, so those are instead
+// considered cached if they loaded near-instantly.
+func (c ClientCallInfo) fromCache() bool {
+	if c.TransferSize != 0 {
+		return false
+	}
+	if c.DecodedBodySize > 0 {
+		return true
+	}
+	return c.durationMs() < cachedMaxDuration
+}
+
+// opaqueTiming reports whether the browser hid the detailed timings of the
+// resource, as it does for cross-origin resources served without a
+// Timing-Allow-Origin header: every milestone between the start of the
+// fetch and the end of the response is then 0. Only the total duration of
+// such resources is known.
+func (c ClientCallInfo) opaqueTiming() bool {
+	return c.EntryType == "resource" &&
+		c.DomainLookupStart == 0 && c.ConnectStart == 0 &&
+		c.RequestStart == 0 && c.ResponseStart == 0
+}
+
+// ttfb returns the time from sending the request for the resource to the
+// first byte of its response, or 0 if the browser didn't report it.
+func (c ClientCallInfo) ttfb() time.Duration {
+	if c.RequestStart == 0 || c.ResponseStart < c.RequestStart {
+		return 0
+	}
+	return msDuration(c.ResponseStart - c.RequestStart)
+}
+
+// timingPhase is one network phase (DNS, TCP, ...) of a resource fetch.
+type timingPhase struct {
+	Name       string
+	Start, End float64
+}
+
+// phases breaks the resource fetch down into its network phases. Phases
+// whose starting milestone was not reported by the browser are omitted, so
+// for example plain HTTP resources (SecureConnectionStart == 0) get no TLS
+// phase rather than a zero-length one, and resources which weren't
+// redirected no Redirect phase.
 //
-// The returned value is incomplete and should have its Response and
-// ServerRecv/ServerSend values set before being logged.
+// The Redirect phase covers the whole redirect chain, and precedes the fetch
+// of the final URL (StartOffsetMs). Resources with opaque timings have no
+// phases at all.
+func (c ClientCallInfo) phases() []timingPhase {
+	if c.opaqueTiming() {
+		return nil
+	}
+	all := []timingPhase{
+		{"Redirect", c.RedirectStart, c.RedirectEnd},
+		{"DNS", c.DomainLookupStart, c.DomainLookupEnd},
+		{"TCP", c.ConnectStart, c.ConnectEnd},
+		{"TLS", c.SecureConnectionStart, c.ConnectEnd},
+		{"TTFB", c.RequestStart, c.ResponseStart},
+		{"Content Download", c.ResponseStart, c.ResponseEnd},
+	}
+	var ps []timingPhase
+	for _, p := range all {
+		if p.Start == 0 || p.End < p.Start {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
 
-// RequestInfo describes an HTTP request.
-type RequestInfo struct {
-	Method        string
-	URI           string
-	Proto         string
-	Headers       map[string]string
-	Host          string
-	RemoteAddr    string
-	ContentLength int64
+// ClientInfo describes the browser which posted a beacon, so that load times
+// can be sliced by browser and connection.
+type ClientInfo struct {
+	UserAgent string
+	ClientIP  string
+
+	// EffectiveConnectionType, Downlink (in Mbps) and SaveData come from the
+	// ECT, Downlink and Save-Data client hints, when the browser sends them.
+	EffectiveConnectionType string
+	Downlink                string
+	SaveData                bool
+}
+
+// NewClientInfo returns information about the browser which sent r.
+func NewClientInfo(r *http.Request) ClientInfo {
+	return ClientInfo{
+		UserAgent:               r.UserAgent(),
+		ClientIP:                clientIP(r),
+		EffectiveConnectionType: r.Header.Get("ECT"),
+		Downlink:                r.Header.Get("Downlink"),
+		SaveData:                strings.EqualFold(r.Header.Get("Save-Data"), "on"),
+	}
 }
 
-// ResponseInfo describes an HTTP response.
-type ResponseInfo struct {
-	Headers       map[string]string
-	ContentLength int64
-	StatusCode    int
+// clientIP returns the IP address of the client which sent r. When behind a
+// proxy that is the first address in X-Forwarded-For, otherwise the address
+// r came from. The header is not authenticated, so the result is only fit
+// for reporting.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-// NewServerEvent describes event to be stored.
-func NewServerEvent() *ServerEvent {
-	return &ServerEvent{}
+// NewResourceEvent returns an event describing the browser resource c, placed
+// on the timeline relative to pageLoadStart (the page's time origin).
+func NewResourceEvent(c ClientCallInfo, pageLoadStart time.Time) *ResourceEvent {
+	e := &ResourceEvent{
+		URL:             c.Name,
+		Route:           pagePath(c.Name, nil),
+		InitiatorType:   c.InitiatorType,
+		EntryType:       c.EntryType,
+		Protocol:        c.Protocol,
+		TransferSize:    byteSize(c.TransferSize),
+		EncodedBodySize: byteSize(c.EncodedBodySize),
+		DecodedBodySize: byteSize(c.DecodedBodySize),
+		FromCache:       c.fromCache(),
+		Status:          c.Status,
+		TTFB:            c.ttfb(),
+		OpaqueTiming:    c.opaqueTiming(),
+	}
+	if e.Protocol == "" {
+		e.Protocol = "unknown"
+	}
+	// The browser's duration runs from the entry's startTime, which for a
+	// redirected resource is the start of the redirect chain rather than
+	// the fetch of the final URL (StartOffsetMs). Start the span there too,
+	// so that it ends at responseEnd and its Redirect phase lies within it.
+	start := c.startMs()
+	if c.RedirectStart > 0 && c.RedirectStart < start {
+		start = c.RedirectStart
+	}
+	e.FetchStart, e.ResponseEnd = computeSpan(pageLoadStart, start, c.durationMs())
+	e.Duration = e.ResponseEnd.Sub(e.FetchStart)
+	return e
 }
 
-// ServerEvent records an HTTP server request handling event.
-type ServerEvent struct {
-	Request    RequestInfo  `trace:"Server.Request"`
-	Response   ResponseInfo `trace:"Server.Response"`
-	Route      string       `trace:"Server.Route"`
-	User       string       `trace:"Server.User"`
-	ServerRecv time.Time    `trace:"Server.Recv"`
-	ServerSend time.Time    `trace:"Server.Send"`
+// ResourceEvent records a resource (script, stylesheet, image, ...) loaded by
+// the browser, as reported by the Resource Timing API. Sizes are in bytes, -1
+// meaning unknown. TTFB is the time the browser waited for the first byte of
+// the response once it sent the request, which tells a slow backend from a
+// slow transfer; it is 0 if unknown, e.g. when OpaqueTiming is set because
+// the browser only reported the resource's total duration.
+type ResourceEvent struct {
+	URL             string        `trace:"Resource.URL"`
+	Route           string        `trace:"Resource.Route"` // the path of URL, for grouping resources by route
+	InitiatorType   string        `trace:"Resource.Initiator"`
+	EntryType       string        `trace:"Resource.EntryType"`
+	Protocol        string        `trace:"Resource.Protocol"` // as the browser names it, e.g. "h2" rather than "HTTP/2.0"
+	TransferSize    int64         `trace:"Resource.TransferSize"`
+	EncodedBodySize int64         `trace:"Resource.EncodedBodySize"`
+	DecodedBodySize int64         `trace:"Resource.DecodedBodySize"`
+	FromCache       bool          `trace:"Resource.FromCache"`
+	Status          int           `trace:"Resource.Status"` // 0 if unknown
+	Duration        time.Duration `trace:"Resource.Duration"`
+	TTFB            time.Duration `trace:"Resource.TTFB"`
+	OpaqueTiming    bool          `trace:"Resource.OpaqueTiming"`
+	Slow            bool          `trace:"Resource.Slow"`  // took longer than -slow-threshold
+	Large           bool          `trace:"Resource.Large"` // transferred more than -size-threshold
+	FetchStart      time.Time     `trace:"Resource.FetchStart"`
+	ResponseEnd     time.Time     `trace:"Resource.ResponseEnd"`
+	Client          ClientInfo    `trace:"Resource.Client"`
 }
 
-// Schema returns the constant "HTTPServer".
-func (ServerEvent) Schema() string { return "HTTPServer" }
+// Schema returns the constant "Resource".
+func (ResourceEvent) Schema() string { return "Resource" }
+
+// Important implements the appdash ImportantEvent. The status of resources
+// which failed to load, and the flags of slow and large ones, are included,
+// so that they stand out.
+func (e ResourceEvent) Important() []string {
+	important := []string{"Resource.Initiator", "Resource.Duration"}
+	if e.Failed() {
+		important = append(important, "Resource.Status")
+	}
+	if e.Slow {
+		important = append(important, "Resource.Slow")
+	}
+	if e.Large {
+		important = append(important, "Resource.Large")
+	}
+	return important
+}
+
+// Failed reports whether the resource is known to have failed to load: its
+// response was a client or server error (4xx or 5xx). Redirects are followed
+// by the browser, and a status of 0 is unknown rather than a failure.
+func (e ResourceEvent) Failed() bool {
+	return e.Status >= 400
+}
+
+// Start implements the appdash TimespanEvent interface.
+func (e ResourceEvent) Start() time.Time { return e.FetchStart }
+
+// End implements the appdash TimespanEvent interface.
+func (e ResourceEvent) End() time.Time { return e.ResponseEnd }
+
+// NewServerTimingEvent returns an event for the Server-Timing metric m of the
+// resource c, relative to pageLoadStart. The header only gives durations, so
+// the metric is placed at the start of the request.
+func NewServerTimingEvent(m ServerTimingMetric, c ClientCallInfo, pageLoadStart time.Time) *ServerTimingEvent {
+	start := c.RequestStart
+	if start == 0 {
+		start = c.startMs()
+	}
+	e := &ServerTimingEvent{
+		Name:        m.Name,
+		Description: m.Description,
+		Duration:    msDuration(m.Duration),
+	}
+	e.SpanStart, e.SpanEnd = computeSpan(pageLoadStart, start, m.Duration)
+	return e
+}
+
+// ServerTimingEvent records a metric of the Server-Timing header of a
+// resource's response, such as the time spent querying the database.
+type ServerTimingEvent struct {
+	Name        string        `trace:"ServerTiming.Name"`
+	Description string        `trace:"ServerTiming.Description"`
+	Duration    time.Duration `trace:"ServerTiming.Duration"`
+	SpanStart   time.Time     `trace:"ServerTiming.Start"`
+	SpanEnd     time.Time     `trace:"ServerTiming.End"`
+}
+
+// Schema returns the constant "ServerTiming".
+func (ServerTimingEvent) Schema() string { return "ServerTiming" }
+
+// Important implements the appdash ImportantEvent.
+func (ServerTimingEvent) Important() []string {
+	return []string{"ServerTiming.Duration"}
+}
+
+// Start implements the appdash TimespanEvent interface.
+func (e ServerTimingEvent) Start() time.Time { return e.SpanStart }
+
+// End implements the appdash TimespanEvent interface.
+func (e ServerTimingEvent) End() time.Time { return e.SpanEnd }
+
+func init() {
+	appdash.RegisterEvent(ResourceEvent{})
+	appdash.RegisterEvent(ServerTimingEvent{})
+	appdash.RegisterEvent(NavigationEvent{})
+	appdash.RegisterEvent(PaintInfo{})
+	appdash.RegisterEvent(LCPEvent{})
+	appdash.RegisterEvent(CLSEvent{})
+	appdash.RegisterEvent(PageEvent{})
+	appdash.RegisterEvent(PanicEvent{})
+}
+
+// NewPageEvent returns an event describing the page which posted the entries
+// t, falling back to the Referer and User-Agent headers of r for what the
+// entries don't carry.
+func NewPageEvent(r *http.Request, t []ClientCallInfo) *PageEvent {
+	e := &PageEvent{}
+	for _, c := range t {
+		if e.PageURL == "" {
+			e.PageURL = c.PageURL
+		}
+		if e.UserAgent == "" {
+			e.UserAgent = c.UserAgent
+		}
+	}
+	if e.PageURL == "" {
+		e.PageURL = r.Referer()
+	}
+	if e.UserAgent == "" {
+		e.UserAgent = r.UserAgent()
+	}
+	return e
+}
+
+// PageEvent records the page a page load's trace was posted from and the
+// browser which loaded it, on the root span of the page load.
+type PageEvent struct {
+	PageURL   string `trace:"Page.URL"`
+	UserAgent string `trace:"Page.UserAgent"`
+}
+
+// Schema returns the constant "Page".
+func (PageEvent) Schema() string { return "Page" }
+
+// NewNavigationEvent returns an event describing the load of the page itself,
+// from the navigation entry c, relative to pageLoadStart (the page's time
+// origin).
+func NewNavigationEvent(c ClientCallInfo, pageLoadStart time.Time) *NavigationEvent {
+	return &NavigationEvent{
+		URL:             c.Name,
+		NavigationStart: pageLoadStart.Add(msDuration(c.startMs())),
+		// The navigation starts at the time origin, so responseStart is
+		// the time to the first byte of the document.
+		TimeToFirstByte:       msDuration(c.ResponseStart),
+		DOMInteractive:        pageLoadStart.Add(msDuration(c.DomInteractive)),
+		DOMContentLoadedStart: pageLoadStart.Add(msDuration(c.DomContentLoadedEventStart)),
+		DOMContentLoaded:      pageLoadStart.Add(msDuration(c.DomContentLoadedEventEnd)),
+		DOMComplete:           pageLoadStart.Add(msDuration(c.DomComplete)),
+		LoadEventEnd:          pageLoadStart.Add(msDuration(c.LoadEventEnd)),
+	}
+}
+
+// NavigationEvent records the browser's load of a page document, as reported
+// by the Navigation Timing API.
+type NavigationEvent struct {
+	URL                   string        `trace:"Navigation.URL"`
+	NavigationStart       time.Time     `trace:"Navigation.Start"`
+	TimeToFirstByte       time.Duration `trace:"Navigation.TimeToFirstByte"`
+	DOMInteractive        time.Time     `trace:"Navigation.DOMInteractive"`
+	DOMContentLoadedStart time.Time     `trace:"Navigation.DOMContentLoadedStart"`
+	DOMContentLoaded      time.Time     `trace:"Navigation.DOMContentLoaded"`
+	DOMComplete           time.Time     `trace:"Navigation.DOMComplete"`
+	LoadEventEnd          time.Time     `trace:"Navigation.LoadEventEnd"`
+	Client                ClientInfo    `trace:"Navigation.Client"`
+}
+
+// Schema returns the constant "Navigation".
+func (NavigationEvent) Schema() string { return "Navigation" }
 
 // Important implements the appdash ImportantEvent.
-func (ServerEvent) Important() []string {
-	return []string{"Server.Response.StatusCode"}
+func (NavigationEvent) Important() []string {
+	return []string{"Navigation.TimeToFirstByte"}
 }
 
 // Start implements the appdash TimespanEvent interface.
-func (e ServerEvent) Start() time.Time { return e.ServerRecv }
+func (e NavigationEvent) Start() time.Time { return e.NavigationStart }
 
 // End implements the appdash TimespanEvent interface.
-func (e ServerEvent) End() time.Time { return e.ServerSend }
+func (e NavigationEvent) End() time.Time { return e.LoadEventEnd }
+
+// NewPaintInfo returns the paint timings among the entries t, relative to
+// pageLoadStart, and whether there were any. Browsers without the Paint
+// Timing API report none.
+func NewPaintInfo(t []ClientCallInfo, pageLoadStart time.Time) (*PaintInfo, bool) {
+	p := &PaintInfo{}
+	found := false
+	for _, c := range t {
+		if c.EntryType != "paint" {
+			continue
+		}
+		switch c.Name {
+		case "first-paint":
+			p.FirstPaint = pageLoadStart.Add(msDuration(c.startMs()))
+		case "first-contentful-paint":
+			p.FirstContentfulPaint = pageLoadStart.Add(msDuration(c.startMs()))
+		default:
+			continue
+		}
+		found = true
+	}
+	return p, found
+}
+
+// PaintInfo records when the browser first painted the page, and first
+// painted any of its content, as reported by the Paint Timing API. It is
+// recorded on the root span of the page load.
+type PaintInfo struct {
+	FirstPaint           time.Time `trace:"Paint.FirstPaint"`
+	FirstContentfulPaint time.Time `trace:"Paint.FirstContentfulPaint"`
+}
+
+// Schema returns the constant "Paint".
+func (PaintInfo) Schema() string { return "Paint" }
+
+// NewLCPEvent returns the Largest Contentful Paint reported among the
+// entries t, and whether there was one. Of several "largest-contentful-paint"
+// entries the last is the final one.
+func NewLCPEvent(t []ClientCallInfo) (*LCPEvent, bool) {
+	e := &LCPEvent{}
+	found := false
+	for _, c := range t {
+		if c.EntryType == "largest-contentful-paint" {
+			e.LCP = msDuration(c.startMs())
+			e.Element = c.Element
+			e.URL = c.URL
+			found = true
+		}
+	}
+	return e, found
+}
+
+// LCPEvent records the Largest Contentful Paint of a page load on its root
+// span: the time from the page's time origin to the render of its largest
+// content, the element Element (showing the image URL, if it is one).
+type LCPEvent struct {
+	LCP     time.Duration `trace:"WebVitals.LCP"`
+	Element string        `trace:"WebVitals.LCPElement"`
+	URL     string        `trace:"WebVitals.LCPURL"`
+}
+
+// Schema returns the constant "LCP".
+func (LCPEvent) Schema() string { return "LCP" }
+
+// Important implements the appdash ImportantEvent.
+func (LCPEvent) Important() []string { return []string{"WebVitals.LCP"} }
 
-// We want to create HTTP clients recording to this collector inside our Home
-// handler below, so we use a global variable (for simplicity sake) to store
-// the collector in use. We could also use gorilla/context to store it.
-var collector appdash.Collector
+// NewCLSEvent returns the Cumulative Layout Shift reported among the entries
+// t, and whether there was one.
+func NewCLSEvent(t []ClientCallInfo) (*CLSEvent, bool) {
+	for i := len(t) - 1; i >= 0; i-- {
+		if t[i].EntryType == "layout-shift" {
+			return &CLSEvent{CLS: t[i].Value}, true
+		}
+	}
+	return nil, false
+}
+
+// CLSEvent records the cumulative layout shift score of a page load on its
+// root span. 0 is a measured score like any other: a page load whose score
+// wasn't reported has no CLSEvent, just as one whose LCP wasn't has no
+// LCPEvent.
+type CLSEvent struct {
+	CLS float64 `trace:"WebVitals.CLS"`
+}
+
+// Schema returns the constant "CLS".
+func (CLSEvent) Schema() string { return "CLS" }
+
+// Important implements the appdash ImportantEvent.
+func (CLSEvent) Important() []string { return []string{"WebVitals.CLS"} }
+
+// shutdownFlushTimeout is how long the spans buffered by the collector may
+// take to be flushed on shutdown.
+const shutdownFlushTimeout = 5 * time.Second
+
+// flusher is implemented by collectors which buffer spans before sending
+// them on, such as appdash.ChunkedCollector.
+type flusher interface {
+	Flush() error
+}
+
+// Command-line flags. The defaults match the addresses and retention this
+// app has always used.
+var (
+	uiAddr            = flag.String("ui-addr", ":8700", "address to serve the Appdash web UI on")
+	uiBaseURL         = flag.String("ui-base-url", "", "external URL of the Appdash web UI when served behind a reverse proxy (e.g. https://rum.example.com/appdash), used in the links to it")
+	uiUser            = flag.String("ui-user", "", "user name required to access the Appdash web UI, with -ui-pass (or set $LOADTIMES_UI_USER)")
+	uiPass            = flag.String("ui-pass", "", "password required to access the Appdash web UI, with -ui-user (or set $LOADTIMES_UI_PASS)")
+	appAddr           = flag.String("app-addr", ":8699", "address to serve the webapp and /endpoint on")
+	evictAge          = flag.Duration("evict-age", 5*time.Minute, "how long to keep traces in memory before evicting them (e.g. \"5m\"); 0 keeps them forever")
+	mode              = flag.String("mode", "embedded", `how spans are collected: "embedded" records them directly into this app's store, "remote" sends them over TCP to -collector, or else to the collection server on -collector-addr`)
+	collectorAddr     = flag.String("collector-addr", "", "TCP address to accept spans from remote Appdash collectors on (disabled if empty)")
+	exporter          = flag.String("exporter", "appdash", `where spans go: "appdash" (see -mode), or "otlp" to export them only to the OpenTelemetry collector at -otlp-endpoint`)
+	otlpEndpoint      = flag.String("otlp-endpoint", "", "host:port of an OTLP (gRPC) endpoint to also export spans to (default \""+defaultOTLPEndpoint+"\" with -exporter=otlp)")
+	flushInterval     = flag.Duration("flush-interval", 500*time.Millisecond, "how often buffered spans are sent to the collector; 0 sends each span immediately")
+	remoteCollector   = flag.String("collector", "", "address of a remote Appdash collector to send spans to, instead of storing them here and serving the web UI (implies -mode=remote)")
+	storeKind         = flag.String("store", "memory", `where to keep traces: "memory", "disk" (or "file") to also persist them to -store-path, or "lru" to keep at most -store-max-traces of them in memory`)
+	storePath         = flag.String("store-path", "loadtimes.db", "file to persist traces to with -store=disk")
+	storeMaxTraces    = flag.Int("store-max-traces", 10000, "maximum number of traces kept with -store=lru, the oldest being deleted first")
+	tlsCert           = flag.String("tls-cert", "", "certificate file to serve the webapp and web UI over HTTPS with, with -tls-key")
+	tlsKey            = flag.String("tls-key", "", "private key file of -tls-cert")
+	tlsAutocertDomain = flag.String("tls-autocert-domain", "", "comma-separated domains to serve HTTPS for with certificates from Let's Encrypt, instead of -tls-cert")
+	tlsAutocertCache  = flag.String("tls-autocert-cache", "autocert-cache", "directory to cache the certificates of -tls-autocert-domain in")
+	tlsAutocertHTTP   = flag.String("tls-autocert-http-addr", ":80", "address to answer Let's Encrypt's HTTP-01 challenges for -tls-autocert-domain on, which must be reachable on port 80")
+	apiTimeout        = flag.Duration("api-timeout", 2*time.Second, "timeout of the API requests made to render the home page")
+	endpointURL       = flag.String("endpoint-url", "", "URL the demo page posts its timings to (default this app's /endpoint)")
+	corsOrigin        = flag.String("cors-origin", "*", "comma-separated origins allowed to post to /endpoint besides the app's own, or \"*\" for any")
+	includeTypes      = flag.String("include-types", "", `comma-separated initiator types of the resources to record (e.g. "script,xmlhttprequest"); empty records all`)
+	groupByPath       = flag.Bool("group-by-path", false, "name page load traces after the page's URL path, so that the UI groups them by page")
+	skipCached        = flag.Bool("skip-cached", false, "don't record resources served from the browser cache")
+	logFormat         = flag.String("log-format", "text", `format of the log: "text", or "json" for log pipelines`)
+	logLevel          = flag.String("log-level", "info", `minimum level of the messages logged: "debug", "info", "warn" or "error"`)
+	rateLimit         = flag.Float64("rate-limit", 0, "maximum sustained rate of posts to /endpoint per client IP, in requests per second, or 0 for no limit; clients are told apart by the address they connect from, so those behind a proxy share one limit")
+	rateBurst         = flag.Int("rate-burst", 20, "number of posts to /endpoint a client IP may make in a burst above -rate-limit")
+	dedupeWindow      = flag.Duration("dedupe-window", 2*time.Second, "how long a payload posted to /endpoint is remembered, so that it is recorded only once if posted again; 0 disables deduplication")
+	slowThreshold     = flag.Duration("slow-threshold", time.Second, "flag resources which take longer than this to load as slow; 0 disables")
+	sizeThreshold     = flag.Int64("size-threshold", 500<<10, "flag resources which transfer more than this many bytes as large; 0 disables")
+	maxBody           = flag.Int64("max-body", defaultMaxBody, "maximum size in bytes of a payload posted to /endpoint")
+	retryOnCollectErr = flag.Bool("retry-on-collect-error", false, "reply 503 to payloads posted to /endpoint whose spans couldn't be recorded, so that clients may retry them")
+	sampleRate        = flag.Float64("sample-rate", 1, "fraction of the page loads posting to /endpoint which are recorded, from 0 to 1")
+)
+
+func init() {
+	flag.StringVar(appAddr, "addr", *appAddr, "alias for -app-addr")
+	flag.DurationVar(evictAge, "evict", *evictAge, "alias for -evict-age")
+	flag.StringVar(includeTypes, "initiator-types", *includeTypes, "alias for -include-types")
+	flag.Float64Var(rateLimit, "rate", *rateLimit, "alias for -rate-limit")
+	flag.Float64Var(sampleRate, "sample", *sampleRate, "alias for -sample-rate")
+}
+
+// defaultOTLPEndpoint is where spans are exported with -exporter=otlp and no
+// -otlp-endpoint: the OTLP gRPC port of a local OpenTelemetry collector.
+const defaultOTLPEndpoint = "localhost:4317"
+
+// persistInterval is how often traces are saved to disk with -store=disk.
+const persistInterval = 30 * time.Second
 
 func main() {
-	// Create a recent in-memory store, evicting data after 20s.
-	//
-	// The store defines where information about traces (i.e. spans and
-	// annotations) will be stored during the lifetime of the application. This
-	// application uses a MemoryStore store wrapped by a RecentStore with an
-	// eviction time of 20s (i.e. all data after 20s is deleted from memory).
-	memStore := appdash.NewMemoryStore()
-	store := &appdash.RecentStore{
-		MinEvictAge: 300 * time.Second,
-		DeleteStore: memStore,
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Serves a sample webapp whose browser resource timings are recorded\n")
+		fmt.Fprintf(os.Stderr, "as Appdash traces, along with the Appdash web UI to view them.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		usageError("invalid -log-level %q: %s", *logLevel, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		usageError("invalid -log-format %q: must be \"text\" or \"json\"", *logFormat)
 	}
 
-	// Start the Appdash web UI on port 8700.
-	//
-	// This is the actual Appdash web UI -- usable as a Go package itself, We
-	// embed it directly into our application such that visiting the web server
-	// on HTTP port 8700 will bring us to the web UI, displaying information
-	// about this specific web-server (another alternative would be to connect
-	// to a centralized Appdash collection server).
-	tapp := traceapp.New(nil)
-	tapp.Store = store
-	tapp.Queryer = memStore
-	log.Println("Appdash web UI running on HTTP :8700")
-	go func() {
-		log.Fatal(http.ListenAndServe(":8700", tapp))
-	}()
+	for name, addr := range map[string]string{"app-addr": *appAddr, "ui-addr": *uiAddr, "collector-addr": *collectorAddr, "collector": *remoteCollector} {
+		if addr == "" && (name == "collector-addr" || name == "collector") {
+			continue
+		}
+		if err := checkAddr(addr); err != nil {
+			usageError("invalid -%s %q: %s", name, addr, err)
+		}
+	}
+	// The credentials are best passed through the environment, keeping the
+	// password out of the process list.
+	if *uiUser == "" {
+		*uiUser = os.Getenv("LOADTIMES_UI_USER")
+	}
+	if *uiPass == "" {
+		*uiPass = os.Getenv("LOADTIMES_UI_PASS")
+	}
+	if (*uiUser == "") != (*uiPass == "") {
+		usageError("-ui-user and -ui-pass must be set together")
+	}
+	if *rateLimit < 0 {
+		usageError("invalid -rate-limit %v: must not be negative", *rateLimit)
+	}
+	if *rateBurst < 1 {
+		usageError("invalid -rate-burst %d: must be at least 1", *rateBurst)
+	}
+	if *sampleRate < 0 || *sampleRate > 1 {
+		usageError("invalid -sample-rate %v: must be between 0 and 1", *sampleRate)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		usageError("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCert != "" && *tlsAutocertDomain != "" {
+		usageError("-tls-autocert-domain can't be used with -tls-cert")
+	}
+	if *tlsAutocertDomain != "" {
+		if err := checkAddr(*tlsAutocertHTTP); err != nil {
+			usageError("invalid -tls-autocert-http-addr %q: %s", *tlsAutocertHTTP, err)
+		}
+	}
+	tlsConfig, acmeHandler, err := serverTLSConfig()
+	if err != nil {
+		usageError("invalid -tls-cert or -tls-key: %s", err)
+	}
+	if err := checkEndpointURL(*endpointURL); err != nil {
+		usageError("invalid -endpoint-url %q: %s", *endpointURL, err)
+	}
+	if *uiBaseURL != "" {
+		if u, err := url.Parse(*uiBaseURL); err != nil || !u.IsAbs() {
+			usageError("invalid -ui-base-url %q: must be an absolute URL", *uiBaseURL)
+		}
+	}
+	if *storeKind == "file" {
+		*storeKind = "disk"
+	}
+	if *storeKind != "memory" && *storeKind != "disk" && *storeKind != "lru" {
+		usageError("invalid -store %q: must be \"memory\", \"disk\", \"file\" or \"lru\"", *storeKind)
+	}
+	if *storeKind == "lru" && *storeMaxTraces < 1 {
+		usageError("invalid -store-max-traces %d: must be at least 1", *storeMaxTraces)
+	}
+	if *remoteCollector != "" {
+		if *collectorAddr != "" {
+			usageError("-collector-addr can't be used with -collector: there is no local store to collect spans into")
+		}
+		*mode = "remote"
+	}
+	switch *exporter {
+	case "appdash":
+	case "otlp":
+		if *mode == "remote" || *collectorAddr != "" {
+			usageError("-exporter=otlp can't be used with -mode=remote, -collector or -collector-addr")
+		}
+		if *otlpEndpoint == "" {
+			*otlpEndpoint = defaultOTLPEndpoint
+		}
+	default:
+		usageError("invalid -exporter %q: must be \"appdash\" or \"otlp\"", *exporter)
+	}
+	if *otlpEndpoint != "" {
+		if err := checkAddr(*otlpEndpoint); err != nil {
+			usageError("invalid -otlp-endpoint %q: %s", *otlpEndpoint, err)
+		}
+	}
+	switch *mode {
+	case "embedded":
+	case "remote":
+		if *remoteCollector == "" && *collectorAddr == "" {
+			usageError("-mode=remote requires -collector or -collector-addr")
+		}
+	default:
+		usageError("invalid -mode %q: must be \"embedded\" or \"remote\"", *mode)
+	}
+
+	// Unless spans are sent to a remote Appdash server, record them into a
+	// store of our own and serve the Appdash web UI for it.
+	var (
+		collector appdash.Collector
+		queryer   appdash.Queryer      // nil with -collector
+		memStore  *appdash.MemoryStore // nil with -collector
+		uiServer  *http.Server         // nil with -collector
+		dependsOn []string             // addresses which must be up for the app to be ready
+	)
+	if *remoteCollector == "" && *exporter == "appdash" {
+		var store appdash.Store
+		memStore, store, uiServer = startEmbedded(tlsConfig)
+		queryer = memStore
+		dependsOn = append(dependsOn, *uiAddr)
+
+		// We will use a local collector (as we are running the Appdash web UI
+		// embedded within our app).
+		//
+		// A collector is responsible for collecting the information about traces
+		// (i.e. spans and annotations) and placing them into a store. In this app
+		// we use a local collector (we could also use a remote collector, sending
+		// the information to a remote Appdash collection server).
+		collector = appdash.NewLocalCollector(store)
+	}
 
-	// We will use a local collector (as we are running the Appdash web UI
-	// embedded within our app).
+	// Optionally accept spans from other applications over the Appdash
+	// collection protocol, which can then use appdash.NewRemoteCollector
+	// pointed at -collector-addr to record into this app's store and web UI.
+	if *collectorAddr != "" {
+		l, err := net.Listen("tcp", *collectorAddr)
+		if err != nil {
+			fatal("listening for spans", "addr", *collectorAddr, "error", err)
+		}
+		slog.Info("Appdash collector listening", "addr", *collectorAddr)
+		go appdash.NewServer(l, collector).Start()
+	}
+
+	// With -mode=remote this app ships its spans over the collection
+	// protocol: to the Appdash server at -collector, which serves the web UI,
+	// or else to the collection server started above, just as any other
+	// instance of the app pointed at it would.
+	if *mode == "remote" {
+		addr := *remoteCollector
+		if addr == "" {
+			addr = *collectorAddr
+		}
+		waitForCollector(addr)
+		slog.Info("sending spans to Appdash collector", "addr", addr)
+		remote := appdash.NewRemoteCollector(addr)
+		defer remote.Close()
+		collector = remote
+		dependsOn = append(dependsOn, addr)
+	}
+
+	// With -otlp-endpoint spans are also exported to an OpenTelemetry
+	// collector, or only there with -exporter=otlp.
+	var otlp *otlpCollector
+	if *otlpEndpoint != "" {
+		var err error
+		otlp, err = newOTLPCollector(context.Background(), *otlpEndpoint)
+		if err != nil {
+			fatal("creating OTLP exporter", "error", err)
+		}
+		slog.Info("exporting spans over OTLP", "endpoint", *otlpEndpoint)
+		if collector == nil {
+			collector = otlp
+		} else {
+			collector = MultiCollector{collector, otlp}
+		}
+	}
+
+	// Buffer spans and send them to the collector in chunks every
+	// -flush-interval, rather than each on its own: a single page load
+	// easily records hundreds of spans.
 	//
-	// A collector is responsible for collecting the information about traces
-	// (i.e. spans and annotations) and placing them into a store. In this app
-	// we use a local collector (we could also use a remote collector, sending
-	// the information to a remote Appdash collection server).
-	collector = appdash.NewLocalCollector(store)
+	// The size of the queue each flush sends is kept, to report how many
+	// spans the flush on shutdown saved, and the errors of the flushes are
+	// counted for Readyz.
+	var flushQueue atomic.Int64
+	status := &collectStatus{}
+	if *flushInterval > 0 {
+		sc := &statusCollector{Collector: collector, Status: status}
+		chunked := appdash.NewChunkedCollector(sc)
+		chunked.MinInterval = *flushInterval
+		chunked.OnFlush = func(queueSize int) {
+			flushQueue.Store(int64(queueSize))
+			sc.OnFlush()
+		}
+		defer chunked.Stop()
+		collector = chunked
+	}
+	app, err := NewApp(collector, queryer, Config{
+		UIAddr:              *uiAddr,
+		UIBaseURL:           *uiBaseURL,
+		AppAddr:             *appAddr,
+		APITimeout:          *apiTimeout,
+		TLS:                 tlsConfig != nil,
+		EndpointURL:         *endpointURL,
+		CORSOrigin:          *corsOrigin,
+		MaxBody:             *maxBody,
+		IncludeTypes:        *includeTypes,
+		SkipCached:          *skipCached,
+		GroupByPath:         *groupByPath,
+		SessionAge:          *evictAge,
+		RateLimit:           *rateLimit,
+		RateBurst:           *rateBurst,
+		SampleRate:          configSampleRate(*sampleRate),
+		DedupeWindow:        *dedupeWindow,
+		SlowThreshold:       *slowThreshold,
+		SizeThreshold:       *sizeThreshold,
+		RetryOnCollectError: *retryOnCollectErr,
+	})
+	if err != nil {
+		fatal("creating app", "error", err)
+	}
+	app.CollectStatus = status
+	if len(dependsOn) > 0 {
+		app.ReadyCheck = dialCheck(dependsOn...)
+	}
 
 	// Create the appdash/httptrace middleware.
 	//
@@ -142,178 +926,1123 @@ func main() {
 	tracemw := httptrace.Middleware(collector, &httptrace.MiddlewareConfig{
 		RouteName: func(r *http.Request) string { return r.URL.Path },
 		SetContextSpan: func(r *http.Request, spanID appdash.SpanID) {
-			context.Set(r, CtxSpanID, spanID)
+			gcontext.Set(r, CtxSpanID, spanID)
 		},
 	})
 
 	// Setup our router (for information, see the gorilla/mux docs):
 	router := mux.NewRouter()
-	router.HandleFunc("/", Home)
-	router.HandleFunc("/endpoint", Endpoint)
+	router.HandleFunc("/", app.Home)
+	router.HandleFunc("/api", API)
+	router.HandleFunc("/loadPerformanceData.js", ClientScript)
+	router.HandleFunc("/endpoint", app.cors(app.rateLimit(app.Endpoint)))
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/stats", app.Stats)
+	router.HandleFunc("/har", app.HAR)
+	router.HandleFunc("/summary", app.Summary)
+	router.HandleFunc("/aggregate", app.Aggregate)
+	router.HandleFunc("/domains", app.Domains)
+	router.HandleFunc("/traces.json", app.TracesJSON)
+	router.HandleFunc("/stream", app.Stream)
+	router.HandleFunc("/live", app.Live)
 
 	// Setup Negroni for our app (for information, see the negroni docs):
 	n := negroni.Classic()
-	n.Use(negroni.HandlerFunc(tracemw)) // Register appdash's HTTP middleware.
+	// Record panics on the request's span before Negroni's own recovery
+	// gets to them, which would only log them.
+	n.Use(recoverPanics(collector))
+	// Register appdash's HTTP middleware, except for /endpoint: tracing the
+	// beacons which carry the browser timings would only clutter the UI with
+	// traces of the collection itself.
+	n.Use(skipPaths(tracemw, untracedPaths))
 	n.UseHandler(router)
-	n.Run(":8699")
+
+	// The liveness and readiness probes are served in front of Negroni, so
+	// that probe traffic is neither logged nor traced.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", app.Readyz)
+	mux.Handle("/", n)
+
+	appServer := &http.Server{Addr: *appAddr, Handler: mux, TLSConfig: tlsConfig}
+	appServer.RegisterOnShutdown(app.Broadcaster.close)
+	slog.Info("listening", "addr", *appAddr, "tls", tlsConfig != nil)
+	go func() {
+		listen := appServer.ListenAndServe
+		if tlsConfig != nil {
+			// The certificates are in tlsConfig already.
+			listen = func() error { return appServer.ListenAndServeTLS("", "") }
+		}
+		if err := listen(); err != http.ErrServerClosed {
+			fatal("app server", "addr", *appAddr, "error", err)
+		}
+	}()
+
+	// Let's Encrypt checks that we control -tls-autocert-domain over plain
+	// HTTP, on port 80 (see serverTLSConfig).
+	var acmeServer *http.Server
+	if acmeHandler != nil {
+		acmeServer = &http.Server{Addr: *tlsAutocertHTTP, Handler: acmeHandler}
+		slog.Info("answering ACME HTTP-01 challenges", "addr", *tlsAutocertHTTP)
+		go func() {
+			if err := acmeServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("ACME challenge server", "addr", *tlsAutocertHTTP, "error", err)
+			}
+		}()
+	}
+
+	// Wait for SIGINT (Ctrl-C) or SIGTERM (e.g. a container being stopped)
+	// and then shut both servers down gracefully, giving in-flight requests
+	// up to 5s to complete so their spans make it into the store. The
+	// RecentStore runs no background goroutine (it evicts as part of
+	// Collect), so there is nothing else to stop.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := appServer.Shutdown(ctx); err != nil {
+		slog.Error("app server shutdown", "error", err)
+	}
+	if uiServer != nil {
+		if err := uiServer.Shutdown(ctx); err != nil {
+			slog.Error("Appdash web UI shutdown", "error", err)
+		}
+	}
+	if acmeServer != nil {
+		if err := acmeServer.Shutdown(ctx); err != nil {
+			slog.Error("ACME challenge server shutdown", "error", err)
+		}
+	}
+
+	// Collectors which buffer spans (such as appdash.ChunkedCollector) must
+	// be flushed, or the spans still buffered are lost. The flush gets its
+	// own deadline, as the servers' shutdown may have used up theirs.
+	if _, ok := collector.(flusher); ok {
+		flushCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+		err := app.Flush(flushCtx)
+		cancel()
+		if err != nil {
+			slog.Error("flushing collector", "dropped_spans", flushQueue.Load(), "error", err)
+		} else {
+			slog.Info("flushed collector", "flushed_spans", flushQueue.Load())
+		}
+	}
+	if otlp != nil {
+		if err := otlp.Shutdown(ctx); err != nil {
+			slog.Error("OTLP exporter shutdown", "error", err)
+		}
+	}
+	if memStore != nil && *storeKind == "disk" {
+		if err := saveStore(memStore, *storePath); err != nil {
+			slog.Error("saving traces", "path", *storePath, "error", err)
+		}
+	}
+}
+
+// startEmbedded creates the store traces are recorded into and starts the
+// embedded Appdash web UI serving them, over HTTPS if tlsConfig is non-nil.
+func startEmbedded(tlsConfig *tls.Config) (memStore *appdash.MemoryStore, store appdash.Store, uiServer *http.Server) {
+	// Create a recent in-memory store, evicting data after -evict-age (see
+	// newStore).
+	//
+	// The store defines where information about traces (i.e. spans and
+	// annotations) will be stored during the lifetime of the application.
+	memStore, store = newStore(*storeKind, *evictAge, *storeMaxTraces)
+
+	// With -store=disk the MemoryStore is additionally persisted to
+	// -store-path: loaded from it on startup, saved to it periodically and
+	// saved once more on shutdown. Eviction still applies as above, to the
+	// loaded traces too.
+	if *storeKind == "disk" {
+		if err := loadStore(store, *storePath); err != nil {
+			fatal("loading traces", "path", *storePath, "error", err)
+		}
+		slog.Info("persisting traces", "path", *storePath)
+		go func() {
+			if err := appdash.PersistEvery(memStore, persistInterval, *storePath); err != nil {
+				slog.Error("persisting traces", "path", *storePath, "error", err)
+			}
+		}()
+	}
+
+	// Start the Appdash web UI on -ui-addr.
+	//
+	// This is the actual Appdash web UI -- usable as a Go package itself, We
+	// embed it directly into our application such that visiting the web server
+	// on -ui-addr will bring us to the web UI, displaying information
+	// about this specific web-server (another alternative would be to connect
+	// to a centralized Appdash collection server).
+	//
+	// The UI's pages link relative to -ui-base-url, so that they resolve
+	// behind a reverse proxy serving it at a path prefix, as this app's own
+	// links to the UI do.
+	tapp, err := traceapp.New(nil, uiBase(*uiBaseURL, *uiAddr, tlsConfig != nil))
+	if err != nil {
+		fatal("Appdash web UI", "error", err)
+	}
+	tapp.Store = store
+	tapp.Queryer = memStore
+	var ui http.Handler = tapp
+	if *uiUser != "" {
+		ui = basicAuth(tapp, *uiUser, *uiPass)
+	}
+
+	// The UI's listener is bound before returning, so that the app (and
+	// its readiness probe) only comes up once the UI is reachable.
+	l, err := net.Listen("tcp", *uiAddr)
+	if err != nil {
+		fatal("Appdash web UI", "addr", *uiAddr, "error", err)
+	}
+	uiServer = &http.Server{Addr: *uiAddr, Handler: ui, TLSConfig: tlsConfig}
+	slog.Info("Appdash web UI running", "addr", *uiAddr, "tls", tlsConfig != nil)
+	go func() {
+		serve := uiServer.Serve
+		if tlsConfig != nil {
+			serve = func(l net.Listener) error { return uiServer.ServeTLS(l, "", "") }
+		}
+		if err := serve(l); err != http.ErrServerClosed {
+			fatal("Appdash web UI", "addr", *uiAddr, "error", err)
+		}
+	}()
+	return memStore, store, uiServer
+}
+
+// uiBase returns the base URL the Appdash web UI links relative to, which
+// traceapp requires to be absolute: s, the -ui-base-url (which main has
+// checked is an absolute URL), as a directory, or else the root of addr, the
+// -ui-addr, over HTTPS if tls is set. An addr with no host (e.g. ":8700")
+// listens on all interfaces, including localhost's.
+func uiBase(s, addr string, tls bool) *url.URL {
+	if u, err := url.Parse(s); s != "" && err == nil {
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		return u
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	u := &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/"}
+	if tls {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// waitForCollector blocks until the remote Appdash collector at addr accepts
+// connections, retrying with exponential backoff rather than failing startup
+// while it is still coming up.
+func waitForCollector(addr string) {
+	const maxBackoff = 30 * time.Second
+	backoff := 500 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		slog.Warn("Appdash collector unreachable", "addr", addr, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// untracedPaths are the paths of the app which aren't traced: /endpoint, the
+// client script, the APIs reading the traces back and the probes.
+var untracedPaths = map[string]bool{
+	"/endpoint":               true,
+	"/loadPerformanceData.js": true,
+	"/metrics":                true,
+	"/stats":                  true,
+	"/har":                    true,
+	"/summary":                true,
+	"/aggregate":              true,
+	"/domains":                true,
+	"/traces.json":            true,
+	"/stream":                 true,
+	"/live":                   true,
+	"/healthz":                true,
+	"/readyz":                 true,
+}
+
+// skipPaths wraps the Negroni middleware next so that requests for any of the
+// paths in set bypass it and go straight to the next handler.
+func skipPaths(next negroni.HandlerFunc, set map[string]bool) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+		if set[r.URL.Path] {
+			h(w, r)
+			return
+		}
+		next(w, r, h)
+	}
+}
+
+// fatal logs msg and the key-value pairs args at error level, then exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// usageError reports a bad command-line flag, prints the usage and exits.
+func usageError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// configSampleRate returns the Config.SampleRate for the -sample-rate rate:
+// Config takes zero as unset, so a rate of 0, recording nothing, is passed
+// as a negative one.
+func configSampleRate(rate float64) float64 {
+	if rate == 0 {
+		return -1
+	}
+	return rate
+}
+
+// checkAddr checks that addr is a valid "host:port" listen address.
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
+
+// uiURL returns the base URL of the Appdash web UI, as reachable by the
+// browser which sent r: -ui-base-url if set, or else -ui-addr. When
+// -ui-addr has no host (e.g. ":8700") the UI listens on all interfaces, so
+// the host the browser used to reach this app is used.
+func (a *App) uiURL(r *http.Request) string {
+	if a.UIBaseURL != "" {
+		return strings.TrimSuffix(a.UIBaseURL, "/")
+	}
+	host, port, _ := net.SplitHostPort(a.UIAddr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	scheme := "http://"
+	if a.TLS {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// apiURL returns the absolute URL of the API Home calls, this app's own /api,
+// and the address to connect to for it. The URL names the host the browser
+// which sent r used to reach this app, which the app's certificate covers
+// when serving TLS, but the connection is made to -app-addr directly (on
+// the loopback interface if it has no host), so that the call doesn't
+// leave the machine.
+func (a *App) apiURL(r *http.Request) (u, addr string) {
+	host, port, _ := net.SplitHostPort(a.AppAddr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	addr = net.JoinHostPort(host, port)
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	} else if r.Host != "" {
+		host = r.Host
+	}
+	scheme := "http://"
+	if a.TLS {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, port) + "/api", addr
 }
 
 // Home is the homepage handler for our app.
-func Home(w http.ResponseWriter, r *http.Request) { // Grab the span from the gorilla context. We do this so that we can grab
+func (a *App) Home(w http.ResponseWriter, r *http.Request) { // Grab the span from the gorilla context. We do this so that we can grab
 	// the span.Trace ID and link directly to the trace on the web-page itself!
-	span := context.Get(r, CtxSpanID).(appdash.SpanID)
+	span := gcontext.Get(r, CtxSpanID).(appdash.SpanID)
 
 	// We're going to make some API requests, so we create a HTTP client using
 	// a appdash/httptrace transport here. The transport will inform Appdash of
 	// the HTTP events occuring.
+	//
+	// The requests time out after -api-timeout, and are canceled if the
+	// browser goes away, so that a hung API can't hold up the page forever.
+	apiURL, apiAddr := a.apiURL(r)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, apiAddr)
+	}
 	httpClient := &http.Client{
 		Transport: &httptrace.Transport{
-			Recorder: appdash.NewRecorder(span, collector),
-			SetName:  true,
+			Recorder:  appdash.NewRecorder(span, a.Collector),
+			Transport: transport,
+			SetName:   true,
 		},
+		Timeout: a.APITimeout,
 	}
 
 	// Make three API requests using our HTTP client.
 	for i := 0; i < 3; i++ {
-		resp, err := httpClient.Get("/endpoint")
+		req, err := http.NewRequestWithContext(r.Context(), "GET", apiURL, nil)
 		if err != nil {
-			log.Println("/endpoint:", err)
+			slog.Error("calling API", "trace_id", span.Trace.String(), "url", apiURL, "error", err)
+			break
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			slog.Error("calling API", "trace_id", span.Trace.String(), "url", apiURL, "error", err)
+			if r.Context().Err() != nil {
+				return // the browser went away
+			}
 			continue
 		}
 		resp.Body.Close()
 	}
 
-	// Render the page.
-	fmt.Fprintf(w, `<!DOCTYPE html>
-										<html>
-										<head>
-
-										  <!-- Basic Page Needs
-										  –––––––––––––––––––––––––––––––––––––––––––––––––– -->
-										  <meta charset="utf-8">
-										  <title>Test load</title>
-										  <meta name="description" content="">
-										  <meta name="author" content="">
-
-										  <!-- Mobile Specific Metas
-										  –––––––––––––––––––––––––––––––––––––––––––––––––– -->
-										<meta name="viewport" content="width=device-width, initial-scale=1">
-										<link href="https://bedbathandbeyond.qa.nrdecor.com/js/lib/jqwidgets/styles/jqx.base.css" rel="stylesheet" type="text/css" id="jqw-styles">
-										<link href="https://bedbathandbeyond.qa.nrdecor.com/js/lib/jqwidgets/styles/jqx.office.css" rel="stylesheet" type="text/css" id="jqw-styles">
-										<link href="https://bedbathandbeyond.qa.nrdecor.com/js/lib/justified-gallery/styles/justifiedGallery.css" type="text/css" rel="stylesheet" >
-
-
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/styles.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/widgets.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/common/css/common.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/common/css/jquery-ui-1.9.2.custom.min.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/web/css/web.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/bbb2/web/css/fonts.css" media="all" />
-										<link rel="stylesheet" type="text/css" href="https://bedbathandbeyond.qa.nrdecor.com/skin/frontend/enterprise/default/css/print.css" media="print" />
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/prototype/prototype.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/lib/ccard.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/prototype/validation.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/builder.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/effects.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/dragdrop.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/controls.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/scriptaculous/slider.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/varien/js.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/varien/form.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/varien/menu.js"></script>
-										<script type="text/javascript" src="https://bedbathandbeyond.qa.nrdecor.com/js/mage/translate.js"></script>
-										<script src="https://cdnjs.cloudflare.com/ajax/libs/jquery/3.0.0-alpha1/jquery.min.js"></script>
-
-										  <!-- Scripts
-										  –––––––––––––––––––––––––––––––––––––––––––––––––– -->
-
-										<script type="text/javascript">
-										     $(document).ready(function () {
-										    console.log(window.performance)//.getEntries())
-										    var arr = window.performance.getEntriesByType("resource")
-										    jsonObj = [];
-										     console.log(jsonObj);
-										       $.each( arr, function( i, val ) {
-										         var name = val.name;
-										         var entryType = val.entryType;
-										         var startTime = val.fetchStart;
-										         var endTime = val.duration;
-										         var initiatorType = val.initiatorType;
-
-										         item = {}
-										         item ["name"] = name;
-										         item ["entryType"] = entryType;
-										         item ["startTime"] = startTime;
-										         item ["endTime"] = endTime;
-										         item ["initiatorType"] = initiatorType;
-
-										         jsonObj.push(item);
-										        });
-										        jsonString = JSON.stringify(jsonObj);
-										        console.log(jsonString);
-										        $.ajax({
-										            type: "POST",
-										            url: "http://192.168.70.1:8699/endpoint",
-										            data: jsonString
-										            // success: success,
-										            // dataType: dataType
-										          });
-										     });
-										   </script>
-										</head>
-										<body>
-										<!-- Primary Page Layout
-										  –––––––––––––––––––––––––––––––––––––––––––––––––– -->
-										 <img id="image0"  src="http://flex.madebymufffin.com/images/inacup_donut.jpg" alt="Smiley face" height="42" width="42">
-										<!-- End Document
-										  –––––––––––––––––––––––––––––––––––––––––––––––––– -->
-										</body>
-										</html>
-									`)
-	fmt.Fprintf(w, `<p><a href="http://localhost:8700/traces" target="_">View all traces</a></p>`)
-}
-
-// Endpoint is an example API endpoint. In a real application, the backend of
-// your service would be contacting several external and internal API endpoints
-// which may be the bottleneck of your application.
-//
-// For example purposes we just sleep for 200ms before responding to simulate a
-// slow API endpoint as the bottleneck of your application.
-func Endpoint(w http.ResponseWriter, r *http.Request) {
-	traceID := appdash.NewRootSpanID()
-	decoder := json.NewDecoder(r.Body)
-	var t []ClientCallInfo
-	err := decoder.Decode(&t)
+	// Ask the browser to send the connection client hints with its beacons
+	// (see ClientInfo).
+	w.Header().Set("Accept-CH", "ECT, Downlink, Save-Data")
+
+	// Render the page, gzipped if the browser accepts it.
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	err := homeTemplate.Execute(out, homeData{
+		Endpoint:    a.endpointURL(),
+		PageTraceID: span.String(),
+		FlushMs:     beaconFlushInterval.Milliseconds(),
+		TraceURL:    a.uiURL(r) + "/traces/" + span.Trace.String(),
+		TracesURL:   a.uiURL(r) + "/traces",
+		Assets:      defaultDemoAssets,
+	})
 	if err != nil {
-		log.Println("erooror", err)
+		slog.Error("rendering home page", "trace_id", span.Trace.String(), "error", err)
+	}
+}
+
+// acceptsGzip reports whether the client which sent r accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// API is an example API endpoint, which Home calls to render the page. In a
+// real application, the backend of your service would be contacting several
+// external and internal API endpoints which may be the bottleneck of your
+// application.
+func API(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"ok": true}`+"\n")
+}
+
+// Endpoint records the timings pages post to it (see decodePayload) as spans,
+// under the trace of the request which served the page if known.
+func (a *App) Endpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		payloadsRejected.WithLabelValues("method").Inc()
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+
+	// navigator.sendBeacon can't set request headers, so beacons arrive as
+	// text/plain (or application/x-www-form-urlencoded) rather than
+	// application/json. The body is JSON either way, so read it raw and
+	// decode it for any of these content types.
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !payloadTypes[mt] {
+		payloadsRejected.WithLabelValues("content_type").Inc()
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported content type", r.Header.Get("Content-Type"))
+		return
+	}
+
+	// Large payloads compress well, so clients may gzip them. The -max-body
+	// limit applies to the decompressed payload, so that a small gzip bomb
+	// can't exhaust memory either.
+	payload := r.Body
+	gzipped := strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip")
+	if gzipped {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			payloadsRejected.WithLabelValues("read").Inc()
+			writeJSONError(w, http.StatusBadRequest, "error decompressing payload", err.Error())
+			return
+		}
+		defer gz.Close()
+		payload = gz
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, payload, a.MaxBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		payloadsRejected.WithLabelValues("too_large").Inc()
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "payload too large", fmt.Sprintf("limit is %d bytes", tooLarge.Limit))
+		return
+	} else if err != nil {
+		slog.Warn("reading payload", "event", "payload_rejected", "remote_addr", r.RemoteAddr, "error", err)
+		payloadsRejected.WithLabelValues("read").Inc()
+		msg := "error reading payload"
+		if gzipped {
+			msg = "error decompressing payload"
+		}
+		writeJSONError(w, http.StatusBadRequest, msg, err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// An empty beacon (e.g. fired before any resource was loaded) has
+		// nothing to record.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	t, err := decodePayload(body)
+	var verErr unsupportedVersionError
+	if errors.As(err, &verErr) {
+		slog.Warn("decoding payload", "event", "payload_rejected", "remote_addr", r.RemoteAddr, "version", int(verErr), "error", err)
+		payloadsRejected.WithLabelValues("version").Inc()
+		writeJSONError(w, http.StatusBadRequest, "unsupported payload version", err.Error())
+		return
+	} else if err != nil {
+		slog.Warn("decoding payload", "event", "payload_rejected", "remote_addr", r.RemoteAddr, "bytes", len(body), "error", err)
+		payloadsRejected.WithLabelValues("malformed").Inc()
+		writeJSONError(w, http.StatusBadRequest, "malformed payload", err.Error())
+		return
+	}
+	if err := validateClientCalls(t); err != nil {
+		slog.Warn("invalid payload", "event", "payload_rejected", "remote_addr", r.RemoteAddr, "resource_count", len(t), "error", err)
+		payloadsRejected.WithLabelValues("invalid").Inc()
+		writeJSONError(w, http.StatusUnprocessableEntity, "invalid payload", err.Error())
+		return
+	}
+	t, dropped, clamped := sanitizeTimings(t)
+	if dropped > 0 {
+		slog.Warn("dropping entries with bad timings", "event", "entries_dropped", "remote_addr", r.RemoteAddr, "dropped", dropped)
+		resourcesDropped.WithLabelValues("bad_timing").Add(float64(dropped))
+	}
+	if clamped > 0 {
+		slog.Warn("clamping out-of-range timings", "event", "timings_clamped", "remote_addr", r.RemoteAddr, "clamped", clamped)
+		timingsClamped.Add(float64(clamped))
+	}
+	// With -sample-rate only some page loads are recorded. The decision is
+	// made per page session, so that a trace is never missing some of the
+	// batches of its page load.
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		sessionID = payloadSessionID(t)
+	}
+	if a.Sampler != nil && !a.Sampler.sample(sessionID) {
+		payloadsSampledOut.Inc()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The same payload may be posted again within -dedupe-window, e.g. by a
+	// retry, a page navigated back to or an SPA firing its beacon twice;
+	// record it only once.
+	key := payloadKey(r, sessionID, t)
+	if a.Dedupe != nil && a.Dedupe.seen(key, time.Now()) {
+		payloadsDeduplicated.Inc()
+		if r.URL.Query().Get("silent") == "1" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpointResponse{Duplicate: true})
+		return
+	}
+	// A page may post its entries in several batches (as resources finish
+	// loading), all tagged with the same session ID. Record them into the
+	// same trace, relative to the same time origin.
+	//
+	// The browser reports every timing relative to the page's time origin,
+	// so anchor that origin when the page's first batch is received, as
+	// long before then as the page says it sent it (see payloadOrigin), and
+	// place each resource at its fetchStart offset from it.
+	//
+	// Pages served by Home also pass the span of the request that served
+	// them, so that the page load is nested under it rather than being a
+	// trace of its own. Older scripts pass it as ?trace= instead.
+	var parent *appdash.SpanID
+	pageTraceID := payloadPageTraceID(t)
+	if pageTraceID == "" {
+		pageTraceID = r.URL.Query().Get("trace")
+	}
+	if s := pageTraceID; s != "" {
+		parent, err = appdash.ParseSpanID(s)
+		if err != nil {
+			slog.Warn("ignoring invalid page trace ID", "event", "invalid_trace_id", "remote_addr", r.RemoteAddr, "trace", s, "error", err)
+			parent = nil
+		}
+	}
+	now := time.Now()
+	session := a.Sessions.get(sessionID, parent, payloadOrigin(t, now), now)
+
+	// Record the whole payload into a batch first, so that it reaches the
+	// collector with a single Collect call per span (see spanBatch).
+	batch := newSpanBatch(a.Collector)
+	if session.First {
+		rec := appdash.NewRecorder(session.Root, batch)
+		page := NewPageEvent(r, t)
+		if a.GroupByPath {
+			// Name page loads after the route they loaded, so that the
+			// UI groups the traces of each page together.
+			rec.Name(pagePath(page.PageURL, t))
+		}
+		rec.Event(page)
+		rec.Finish()
+	}
+	recorded := a.recordEntries(batch, session.Root, session.Origin, NewClientInfo(r), t)
+	if err := batch.Flush(); err != nil {
+		// The store may be full or the remote collector unreachable.
+		// Don't lose the payload silently: with -retry-on-collect-error
+		// the client is told to retry it later, which it may as it hasn't
+		// been remembered as recorded. Errors of a collector with
+		// -flush-interval only happen later on, in the background, and
+		// are counted by statusCollector.
+		slog.Warn("recording spans", "event", "record_failed", "trace_id", session.Root.Trace.String(), "remote_addr", r.RemoteAddr, "error", err)
+		collectErrors.Inc()
+		if a.CollectStatus != nil {
+			a.CollectStatus.failed(err, time.Now())
+		}
+		if a.RetryOnCollectError {
+			if a.Dedupe != nil {
+				a.Dedupe.forget(key)
+			}
+			w.Header().Set("Retry-After", "5")
+			writeJSONError(w, http.StatusServiceUnavailable, "error recording spans", err.Error())
+			return
+		}
+	}
+	if a.Broadcaster != nil {
+		a.Broadcaster.publish(newBatchSummary(session.Root.Trace.String(), pagePath(r.Referer(), t), recorded))
+	}
+	slog.Info("beacon recorded", "event", "beacon_recorded", "trace_id", session.Root.Trace.String(), "resource_count", len(t), "remote_addr", r.RemoteAddr)
+
+	// Tell the page which trace its timings went into, so that it can link
+	// to it. Production beacons pass ?silent=1 to save the bytes.
+	if r.URL.Query().Get("silent") == "1" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp := endpointResponse{Trace: session.Root.Trace.String(), Dropped: dropped}
+	if a.Queryer != nil {
+		resp.URL = a.uiURL(r) + "/traces/" + resp.Trace
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// endpointResponse is the JSON body of a successful Endpoint response.
+type endpointResponse struct {
+	Trace string `json:"trace,omitempty"` // the trace ID, in hex
+	URL   string `json:"url,omitempty"`   // the trace in the web UI, if served by this app
+
+	// Dropped is how many entries were left out for their bad timings.
+	Dropped int `json:"dropped,omitempty"`
+
+	// Duplicate is set if the payload had been recorded already, and so
+	// wasn't recorded again.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// payloadKey returns the key identifying the payload of entries t posted
+// with r by the page load sessionID: its Idempotency-Key header if set, or
+// else a hash of the client's IP, the session ID, the page's path and the
+// set of entries. The session ID tells apart two loads of the same page
+// from behind the same IP (e.g. a NAT), which post the same entries. The
+// timings are left out, so that a beacon fired again by the same page load
+// shares its key even though they differ.
+func payloadKey(r *http.Request, sessionID string, t []ClientCallInfo) string {
+	if k := r.Header.Get("Idempotency-Key"); k != "" {
+		return "key:" + k
+	}
+	entries := make([]string, len(t))
+	for i, c := range t {
+		entries[i] = c.EntryType + " " + c.Name
+	}
+	sort.Strings(entries)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", clientIP(r), sessionID, pagePath(r.Referer(), t))
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// payloadSessionID returns the session ID the entries t were posted with,
+// or "" if they carry none.
+func payloadSessionID(t []ClientCallInfo) string {
+	for _, c := range t {
+		if c.SessionID != "" {
+			return c.SessionID
+		}
+	}
+	return ""
+}
+
+// payloadOrigin returns the time origin of the page which posted the entries
+// t, received at now: now less the time since the origin the page sent them
+// at, or now itself if they don't say.
+func payloadOrigin(t []ClientCallInfo, now time.Time) time.Time {
+	for _, c := range t {
+		if ms := c.SentAtMs; ms != nil && *ms >= 0 {
+			return now.Add(-time.Duration(*ms * float64(time.Millisecond)))
+		}
+	}
+	return now
+}
+
+// payloadPageTraceID returns the span of the request which served the page
+// the entries t were posted by, or "" if they don't say.
+func payloadPageTraceID(t []ClientCallInfo) string {
+	for _, c := range t {
+		if c.PageTraceID != "" {
+			return c.PageTraceID
+		}
+	}
+	return ""
+}
+
+// recordEntries records the browser entries t of a page load into c, as
+// spans of the trace rooted at root, and returns the events of the resources
+// it recorded. pageLoadStart is the page's time origin and client the browser
+// which posted the entries.
+//
+// The entries are recorded in the order the browser fetched them, which
+// the order of t needn't be: each span is placed at its own fetchStart
+// offset from the time origin, never at the time it was recorded, and
+// repeats of a URL are numbered in fetch order.
+func (a *App) recordEntries(c appdash.Collector, root appdash.SpanID, pageLoadStart time.Time, client ClientInfo, t []ClientCallInfo) []*ResourceEvent {
+	t = append([]ClientCallInfo(nil), t...)
+	sort.SliceStable(t, func(i, j int) bool { return t[i].startMs() < t[j].startMs() })
+
+	var recorded []*ResourceEvent
+	if paint, ok := NewPaintInfo(t, pageLoadStart); ok {
+		rec := appdash.NewRecorder(root, c)
+		rec.Event(paint)
+		rec.Finish()
+	}
+	// The Web Vitals are recorded as separate events, so that a vital the
+	// page didn't report isn't recorded as 0.
+	if lcp, ok := NewLCPEvent(t); ok {
+		rec := appdash.NewRecorder(root, c)
+		rec.Event(lcp)
+		rec.Finish()
+	}
+	if cls, ok := NewCLSEvent(t); ok {
+		rec := appdash.NewRecorder(root, c)
+		rec.Event(cls)
+		rec.Finish()
 	}
-	startTime := time.Now()
+	seen := make(map[string]int) // resource URL -> times seen
 	for i := 0; i < len(t); i++ {
-		e := NewServerEvent()
-		e.ServerRecv = startTime
-		e.Route = t[i].InitiatorType
-		e.User = "u"
-		e.Response = ResponseInfo{
-			StatusCode: 200,
-			//Headers:    map[string]string{"Span-Id": "0000000000000001/0000000000000002/0000000000000003"},
-		}
-		e.Request = RequestInfo{
-			Method:  "GET",
-			Proto:   "HTTP/1.1",
-			URI:     t[i].Name,
-			Host:    "example.com",
-			Headers: map[string]string{"X-Req-Header": "a"},
-		}
-		duration := t[i].EndTime
-		c := int64(duration)
-		e.ServerSend = time.Unix(0, ((startTime.UnixNano()/1000000)+c)*1000000)
-		traceIDto := appdash.NewSpanID(traceID)
-		rec := appdash.NewRecorder(traceIDto, collector)
-		rec.Name(t[i].Name)
+		// Paint and Web Vitals entries are recorded on the root span above.
+		switch t[i].EntryType {
+		case "paint", "largest-contentful-paint", "layout-shift":
+			continue
+		}
+		// The navigation entry describes the document itself, so it becomes
+		// the root span of the trace and every resource is nested under it.
+		if t[i].EntryType == "navigation" {
+			rec := appdash.NewRecorder(root, c)
+			if !a.GroupByPath {
+				rec.Name(t[i].Name)
+			}
+			nav := NewNavigationEvent(t[i], pageLoadStart)
+			nav.Client = client
+			rec.Event(nav)
+			rec.Finish()
+			continue
+		}
+
+		// Only the resource types asked for with -include-types are
+		// recorded, and counted in the metrics.
+		if !a.includedType(t[i].InitiatorType) {
+			resourcesDropped.WithLabelValues("initiator_type").Inc()
+			continue
+		}
+		// Cache hits are mostly noise when looking for slow network
+		// fetches, so they may be left out entirely.
+		if a.SkipCached && t[i].fromCache() {
+			resourcesDropped.WithLabelValues("cached").Inc()
+			continue
+		}
+
+		e := NewResourceEvent(t[i], pageLoadStart)
+		e.Client = client
+		e.Slow = a.SlowThreshold > 0 && e.Duration > a.SlowThreshold
+		e.Large = a.SizeThreshold > 0 && e.TransferSize > a.SizeThreshold
+		resourcesReceived.WithLabelValues(e.InitiatorType).Inc()
+		resourceDuration.WithLabelValues(e.InitiatorType).Observe(e.Duration.Seconds())
+		if e.TransferSize > 0 {
+			resourceBytes.WithLabelValues(e.InitiatorType).Add(float64(e.TransferSize))
+		}
+		// The same URL may be loaded several times (retries, cache
+		// busting, ...); number the repeats so their spans can be told
+		// apart. The event keeps the URL as is.
+		name := t[i].Name
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s (#%d)", name, seen[name])
+		}
+		// Cache hits are named as such, so that they stand out from the
+		// network fetches in the UI.
+		if e.FromCache {
+			name += " (cached)"
+		}
+		rec := appdash.NewRecorder(appdash.NewSpanID(root), c)
+		rec.Name(name)
 		rec.Event(e)
+		recorded = append(recorded, e)
+
+		// Record each network phase as a child span of the resource.
+		for _, p := range t[i].phases() {
+			child := rec.Child()
+			child.Name(p.Name)
+			var ts appdash.Timespan
+			ts.S, ts.E = computeSpan(pageLoadStart, p.Start, p.End-p.Start)
+			child.Event(ts)
+			child.Finish()
+		}
+
+		// And the server's own breakdown of its response time, if it sent
+		// a Server-Timing header.
+		for _, m := range t[i].ServerTiming {
+			child := rec.Child()
+			child.Name(m.Name)
+			child.Event(NewServerTimingEvent(m, t[i], pageLoadStart))
+			child.Finish()
+		}
 		rec.Finish()
 	}
-	//	time.Now() + time.Duration(194.15)*time.Millisecond
-	// log.Println("I am inside Endpoint", startTime)
-	// log.Println("I am inside Endpoint", endTime)
+	return recorded
+}
+
+// pagePath returns the path of the page which posted the entries t (or of
+// pageURL if they don't say), without its query string or fragment so that
+// every load of a page is grouped together.
+func pagePath(pageURL string, t []ClientCallInfo) string {
+	for _, c := range t {
+		if c.PagePath != "" {
+			pageURL = c.PagePath
+			break
+		}
+	}
+	u, err := url.Parse(pageURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// includedType reports whether -include-types lets resources of the given
+// initiator type be recorded.
+func (a *App) includedType(typ string) bool {
+	if a.IncludeTypes == "" {
+		return true
+	}
+	for _, t := range strings.Split(a.IncludeTypes, ",") {
+		if strings.TrimSpace(t) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadTypes are the content types Endpoint accepts payloads as.
+var payloadTypes = map[string]bool{
+	"application/json":                  true,
+	"text/plain":                        true, // navigator.sendBeacon with a string
+	"application/x-www-form-urlencoded": true,
+}
+
+// payloadVersion is the current version of the payload format, see
+// decodePayload.
+const payloadVersion = 1
+
+// payloadEnvelope is a versioned payload: {"v": 1, "entries": [...]}. The
+// fields describing the page are the same for all its entries, so they are
+// sent once in the envelope; decodePayload copies them to each entry.
+type payloadEnvelope struct {
+	V       int             `json:"v"`
+	Entries json.RawMessage `json:"entries"`
+
+	SessionID   string `json:"sessionId"`
+	PageTraceID string `json:"pageTraceId"`
+	PageURL     string
+	PagePath    string
+	UserAgent   string
+	SentAtMs    *float64 `json:"sentAtMs"`
+}
+
+// fill sets the page fields of c which it doesn't carry itself from env.
+func (env *payloadEnvelope) fill(c *ClientCallInfo) {
+	for _, f := range []struct{ env, c *string }{
+		{&env.SessionID, &c.SessionID},
+		{&env.PageTraceID, &c.PageTraceID},
+		{&env.PageURL, &c.PageURL},
+		{&env.PagePath, &c.PagePath},
+		{&env.UserAgent, &c.UserAgent},
+	} {
+		if *f.c == "" {
+			*f.c = *f.env
+		}
+	}
+	if c.SentAtMs == nil {
+		c.SentAtMs = env.SentAtMs
+	}
+}
+
+// unsupportedVersionError is returned by decodePayload for payloads of a
+// version it doesn't know.
+type unsupportedVersionError int
+
+func (e unsupportedVersionError) Error() string {
+	if e == 0 {
+		return `payload has no version ("v")`
+	}
+	return fmt.Sprintf("payload version %d is not supported (the latest is %d)", int(e), payloadVersion)
+}
+
+// decodePayload decodes the entries of a payload posted to Endpoint. A
+// payload is a payloadEnvelope, whose entries are decoded according to its
+// version, or else a bare array of entries as sent by older clients (see
+// decodeLegacyPayload).
+func decodePayload(body []byte) ([]ClientCallInfo, error) {
+	var t []ClientCallInfo
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		return decodeLegacyPayload(body)
+	}
+
+	var env payloadEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+	switch env.V {
+	case 1:
+		if len(env.Entries) == 0 {
+			return nil, errors.New(`missing "entries"`)
+		}
+		if err := json.Unmarshal(env.Entries, &t); err != nil {
+			return nil, err
+		}
+		for i := range t {
+			env.fill(&t[i])
+		}
+		return t, nil
+	default:
+		return nil, unsupportedVersionError(env.V)
+	}
+}
+
+// decodeLegacyPayload decodes a bare array of entries, as sent by clients
+// which predate payloadEnvelope. Those sent the fetch's start as "startTime"
+// and its duration (despite the name) as "endTime": these are taken as
+// StartOffsetMs and DurationMs, unless an entry carries those too.
+func decodeLegacyPayload(body []byte) ([]ClientCallInfo, error) {
+	var t []ClientCallInfo
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, err
+	}
+	var legacy []struct {
+		StartTime json.RawMessage `json:"startTime"`
+		EndTime   json.RawMessage `json:"endTime"`
+	}
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return nil, err
+	}
+	for i, l := range legacy {
+		c := &t[i]
+		for _, f := range []struct {
+			raw json.RawMessage
+			ms  **float64
+		}{{l.StartTime, &c.StartOffsetMs}, {l.EndTime, &c.DurationMs}} {
+			switch {
+			case f.raw == nil || *f.ms != nil:
+			case string(f.raw) == "null":
+				c.nullTimings = true
+			default:
+				if err := json.Unmarshal(f.raw, f.ms); err != nil {
+					return nil, fmt.Errorf("entry %d: %w", i, err)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// validateClientCalls checks that every entry of a decoded payload carries the
+// fields we need to record it, returning an error naming the first offending
+// entry. A truncated beacon (e.g. one cut off on page unload) typically
+// decodes into entries with no name, or no timings: those would otherwise be
+// recorded as zero-length spans at the time origin. Null timings are not
+// missing but bad, and left for sanitizeTimings to drop.
+func validateClientCalls(calls []ClientCallInfo) error {
+	for i, c := range calls {
+		switch {
+		case c.Name == "":
+			return fmt.Errorf("entry %d: missing name", i)
+		case c.nullTimings:
+		case c.StartOffsetMs == nil:
+			return fmt.Errorf("entry %d (%s): missing startOffsetMs", i, c.Name)
+		case c.DurationMs == nil:
+			return fmt.Errorf("entry %d (%s): missing durationMs", i, c.Name)
+		}
+	}
+	return nil
+}
+
+// maxTimingMs is the largest offset or duration, in milliseconds, taken at
+// face value. Anything beyond is a bogus value, and would squash the rest of
+// the page load into a sliver of the UI's timeline.
+const maxTimingMs = float64(time.Hour / time.Millisecond)
+
+// sanitizeTimings returns the entries of calls whose timings can be
+// recorded, how many it left out and how many of those it returns had their
+// timings clamped. Entries with a NaN or infinite timing (null once through
+// JSON.stringify) or a negative duration are left out, as there is nothing
+// to make of them. Negative offsets and implausibly large ones and
+// durations, which browsers occasionally report after clock adjustments, are
+// clamped to [0, maxTimingMs] instead.
+func sanitizeTimings(calls []ClientCallInfo) (ok []ClientCallInfo, dropped, clamped int) {
+	ok = make([]ClientCallInfo, 0, len(calls))
+	for _, c := range calls {
+		if c.nullTimings || !finiteTimings(c) || c.durationMs() < 0 {
+			dropped++
+			continue
+		}
+		if clampTimings(&c) {
+			clamped++
+		}
+		ok = append(ok, c)
+	}
+	return ok, dropped, clamped
+}
+
+// finiteTimings reports whether none of the timings of c is NaN or
+// infinite.
+func finiteTimings(c ClientCallInfo) bool {
+	finite := func(f float64) bool { return !math.IsNaN(f) && !math.IsInf(f, 0) }
+	for _, f := range []float64{
+		c.startMs(), c.durationMs(),
+		c.RedirectStart, c.RedirectEnd,
+		c.DomainLookupStart, c.DomainLookupEnd, c.ConnectStart, c.ConnectEnd,
+		c.SecureConnectionStart, c.RequestStart, c.ResponseStart, c.ResponseEnd,
+		c.DomInteractive, c.DomContentLoadedEventStart, c.DomContentLoadedEventEnd,
+		c.DomComplete, c.LoadEventEnd,
+		c.Value,
+	} {
+		if !finite(f) {
+			return false
+		}
+	}
+	for _, m := range c.ServerTiming {
+		if !finite(m.Duration) {
+			return false
+		}
+	}
+	return true
+}
+
+// clampTimings clamps the offsets and durations of c to [0, maxTimingMs],
+// and reports whether any was out of range.
+func clampTimings(c *ClientCallInfo) bool {
+	clamped := false
+	clamp := func(f *float64) {
+		switch {
+		case *f < 0:
+			*f = 0
+		case *f > maxTimingMs:
+			*f = maxTimingMs
+		default:
+			return
+		}
+		clamped = true
+	}
+	// The offset and duration point into the caller's entry: clamp copies.
+	for _, p := range []**float64{&c.StartOffsetMs, &c.DurationMs} {
+		if *p != nil {
+			f := **p
+			clamp(&f)
+			*p = &f
+		}
+	}
+	for _, f := range []*float64{
+		&c.RedirectStart, &c.RedirectEnd,
+		&c.DomainLookupStart, &c.DomainLookupEnd, &c.ConnectStart, &c.ConnectEnd,
+		&c.SecureConnectionStart, &c.RequestStart, &c.ResponseStart, &c.ResponseEnd,
+		&c.DomInteractive, &c.DomContentLoadedEventStart, &c.DomContentLoadedEventEnd,
+		&c.DomComplete, &c.LoadEventEnd,
+	} {
+		clamp(f)
+	}
+	if len(c.ServerTiming) > 0 {
+		// Don't clamp the caller's metrics in place.
+		c.ServerTiming = append([]ServerTimingMetric(nil), c.ServerTiming...)
+		for i := range c.ServerTiming {
+			clamp(&c.ServerTiming[i].Duration)
+		}
+	}
+	return clamped
+}
+
+// jsonError is the JSON body of an error response.
+type jsonError struct {
+	Error  string `json:"error"`            // what went wrong
+	Detail string `json:"detail,omitempty"` // specifics, e.g. the parse error
+}
+
+// writeJSONError replies to the request with the given HTTP status code and a
+// jsonError body.
+func writeJSONError(w http.ResponseWriter, code int, msg, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(jsonError{Error: msg, Detail: detail})
+}
+
+// byteSize converts a size reported by the browser to a byte count. The
+// browser reports 0 for sizes it may not disclose (opaque cross-origin
+// resources), which is recorded as -1 (unknown) rather than as an empty
+// resource, following the http.Response.ContentLength convention.
+func byteSize(n float64) int64 {
+	if n <= 0 {
+		return -1
+	}
+	return int64(n)
+}
+
+// msDuration converts a browser timing value in (fractional) milliseconds to
+// a time.Duration. Browser timings have sub-millisecond precision (e.g.
+// 194.15ms), which is preserved rather than truncated to whole milliseconds.
+func msDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// computeSpan returns the start (recv) and end (send) times of a span which
+// started offsetMs after start and lasted durationMs, both in (fractional)
+// milliseconds as reported by the browser.
+func computeSpan(start time.Time, offsetMs, durationMs float64) (recv, send time.Time) {
+	recv = start.Add(msDuration(offsetMs))
+	send = recv.Add(msDuration(durationMs))
+	return recv, send
 }
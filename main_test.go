@@ -0,0 +1,1441 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sourcegraph.com/sourcegraph/appdash"
+	"sourcegraph.com/sourcegraph/appdash/httptrace"
+)
+
+// recordPayload posts body to a fresh App's Endpoint and returns what it
+// recorded, failing the test unless the payload was accepted.
+func recordPayload(t *testing.T, cfg Config, body string) *captureCollector {
+	t.Helper()
+	a, c := newTestApp(cfg)
+	if w := postPayload(a, "/endpoint", body); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	return c
+}
+
+// pageOrigin returns the time origin the page load recorded into c was
+// anchored at, which its navigation entry (at offset 0) starts at.
+func pageOrigin(t *testing.T, c *captureCollector) time.Time {
+	t.Helper()
+	navs := c.withEvent("Navigation")
+	if len(navs) != 1 {
+		t.Fatalf("got %d navigation spans, want 1", len(navs))
+	}
+	var nav NavigationEvent
+	c.event(t, navs[0], &nav)
+	return nav.NavigationStart
+}
+
+func TestEndpointResourceTimespan(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 100, "durationMs": 250},
+		{"name": "/b.css", "entryType": "resource", "startOffsetMs": 600, "durationMs": 50}
+	]`)
+	origin := pageOrigin(t, c)
+	for name, want := range map[string]struct{ offset, duration time.Duration }{
+		"/a.js":  {100 * time.Millisecond, 250 * time.Millisecond},
+		"/b.css": {600 * time.Millisecond, 50 * time.Millisecond},
+	} {
+		e, ok := c.resources(t)[name]
+		if !ok {
+			t.Fatalf("%s: not recorded", name)
+		}
+		// The span starts at the resource's own offset from the time
+		// origin, not when the beacon was received, and lasts exactly as
+		// long as the browser reported.
+		if got := e.Start().Sub(origin); got != want.offset {
+			t.Errorf("%s: starts %s after the time origin, want %s", name, got, want.offset)
+		}
+		if got := e.End().Sub(e.Start()); got != want.duration {
+			t.Errorf("%s: span lasts %s, want %s", name, got, want.duration)
+		}
+		if e.Duration != want.duration {
+			t.Errorf("%s: Duration is %s, want %s", name, e.Duration, want.duration)
+		}
+	}
+}
+
+func TestMsDuration(t *testing.T) {
+	for _, tt := range []struct {
+		ms   float64
+		want time.Duration
+	}{
+		{0, 0},
+		{12.345, 12345000 * time.Nanosecond},
+		{194.15, 194150000 * time.Nanosecond},
+		{1500, 1500 * time.Millisecond},
+	} {
+		if got := msDuration(tt.ms); got != tt.want {
+			t.Errorf("msDuration(%v) = %s, want %s", tt.ms, got, tt.want)
+		}
+	}
+}
+
+func TestComputeSpan(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		offsetMs, durationMs float64
+		recv, send           time.Time
+	}{
+		{0, 0, start, start},
+		{100, 50, start.Add(100 * time.Millisecond), start.Add(150 * time.Millisecond)},
+		{1.5, 12.345, start.Add(1500 * time.Microsecond), start.Add(13845 * time.Microsecond)},
+		{0.001, 0.999, start.Add(time.Microsecond), start.Add(time.Millisecond)},
+	} {
+		recv, send := computeSpan(start, tt.offsetMs, tt.durationMs)
+		if !recv.Equal(tt.recv) || !send.Equal(tt.send) {
+			t.Errorf("computeSpan(start, %v, %v) = start+%s, start+%s, want start+%s, start+%s",
+				tt.offsetMs, tt.durationMs, recv.Sub(start), send.Sub(start), tt.recv.Sub(start), tt.send.Sub(start))
+		}
+	}
+}
+
+func TestEndpointSubMillisecondPrecision(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 100},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 1.5, "durationMs": 12.345}
+	]`)
+	origin := pageOrigin(t, c)
+	e := c.resources(t)["/a.js"]
+	if got, want := e.End().Sub(e.Start()), 12345000*time.Nanosecond; got != want {
+		t.Errorf("span lasts %s, want %s", got, want)
+	}
+	if got, want := e.Start().Sub(origin), 1500*time.Microsecond; got != want {
+		t.Errorf("span starts %s after the time origin, want %s", got, want)
+	}
+}
+
+func TestEndpointRejectsMalformedPayloads(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		body string
+		want int
+	}{
+		{"truncated", `{"v": 1, "entries": [{"name": "/a.js", "startOffs`, http.StatusBadRequest},
+		{"missing name", `[{"entryType": "resource", "startOffsetMs": 1, "durationMs": 2}]`, http.StatusUnprocessableEntity},
+		{"missing start offset", `[{"name": "/a.js", "durationMs": 2}]`, http.StatusUnprocessableEntity},
+		{"missing duration", `[{"name": "/a.js", "startOffsetMs": 1}]`, http.StatusUnprocessableEntity},
+	} {
+		a, c := newTestApp(Config{})
+		w := postPayload(a, "/endpoint", tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want a JSON error", tt.name, ct)
+		}
+		if len(c.spans) != 0 {
+			t.Errorf("%s: %d spans recorded, want none", tt.name, len(c.spans))
+		}
+	}
+}
+
+func TestValidateClientCalls(t *testing.T) {
+	zero := 0.0
+	ok := ClientCallInfo{Name: "/a.js", StartOffsetMs: &zero, DurationMs: &zero}
+	noDuration := ok
+	noDuration.DurationMs = nil
+	if err := validateClientCalls([]ClientCallInfo{ok, ok}); err != nil {
+		t.Errorf("valid entries: got error %q", err)
+	}
+	err := validateClientCalls([]ClientCallInfo{ok, noDuration})
+	if err == nil || !strings.Contains(err.Error(), "entry 1") {
+		t.Errorf("got error %v, want one naming entry 1", err)
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		body       string
+		start, dur float64
+		err        string
+	}{
+		{"envelope", `{"v": 1, "entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]}`, 1, 2, ""},
+		{"extra fields", `{"v": 1, "sent": 123, "entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2, "newField": true}]}`, 1, 2, ""},
+		{"bare array", `[{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]`, 1, 2, ""},
+		{"legacy keys", `[{"name": "/a.js", "startTime": 3, "endTime": 4}]`, 3, 4, ""},
+		{"legacy and current keys", `[{"name": "/a.js", "startTime": 3, "endTime": 4, "startOffsetMs": 1, "durationMs": 2}]`, 1, 2, ""},
+		{"no version", `{"entries": []}`, 0, 0, `no version`},
+		{"unknown version", `{"v": 2, "entries": []}`, 0, 0, `version 2 is not supported`},
+		{"no entries", `{"v": 1}`, 0, 0, `missing "entries"`},
+	} {
+		calls, err := decodePayload([]byte(tt.body))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(calls) != 1 {
+			t.Errorf("%s: got %d entries, want 1", tt.name, len(calls))
+			continue
+		}
+		if c := calls[0]; c.startMs() != tt.start || c.durationMs() != tt.dur {
+			t.Errorf("%s: got start %v and duration %v, want %v and %v", tt.name, c.startMs(), c.durationMs(), tt.start, tt.dur)
+		}
+	}
+
+	// A legacy null timing is dropped rather than missing.
+	calls, err := decodePayload([]byte(`[{"name": "/a.js", "startTime": null, "endTime": 4}]`))
+	if err != nil || len(calls) != 1 || !calls[0].nullTimings {
+		t.Errorf("null legacy timing: got %+v, %v, want an entry with null timings", calls, err)
+	}
+}
+
+func TestEndpointPayloadVersions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		body string
+		want int
+	}{
+		{"envelope", `{"v": 1, "entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]}`, http.StatusOK},
+		{"legacy", `[{"name": "/a.js", "startTime": 1, "endTime": 2}]`, http.StatusOK},
+		{"unknown version", `{"v": 99, "entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]}`, http.StatusBadRequest},
+	} {
+		a, c := newTestApp(Config{})
+		w := postPayload(a, "/endpoint", tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			if !strings.Contains(w.Body.String(), "version 99") {
+				t.Errorf("%s: got body %q, want it to name the version", tt.name, w.Body)
+			}
+			continue
+		}
+		e, ok := c.resources(t)["/a.js"]
+		if !ok {
+			t.Errorf("%s: /a.js not recorded", tt.name)
+			continue
+		}
+		if got := e.End().Sub(e.Start()); got != 2*time.Millisecond {
+			t.Errorf("%s: /a.js lasts %s, want 2ms", tt.name, got)
+		}
+	}
+}
+
+func TestDecodePayloadSizes(t *testing.T) {
+	calls, err := decodePayload([]byte(`{"v": 1, "entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2,
+		"transferSize": 20480, "encodedBodySize": 20000, "decodedBodySize": 61000}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("got %d entries, want 1", len(calls))
+	}
+	if c := calls[0]; c.TransferSize != 20480 || c.EncodedBodySize != 20000 || c.DecodedBodySize != 61000 {
+		t.Errorf("got sizes %v/%v/%v, want 20480/20000/61000", c.TransferSize, c.EncodedBodySize, c.DecodedBodySize)
+	}
+}
+
+func TestDecodePayloadPageFields(t *testing.T) {
+	calls, err := decodePayload([]byte(`{"v": 1, "sessionId": "s1", "pageTraceId": "0000000000000001/0000000000000002",
+		"pageUrl": "http://localhost:8699/?q=1", "pagePath": "/", "userAgent": "Mozilla/5.0 (Envelope)",
+		"entries": [{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2},
+			{"name": "/b.js", "startOffsetMs": 1, "durationMs": 2, "userAgent": "Mozilla/5.0 (Entry)"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got %d entries, want 2", len(calls))
+	}
+	for _, c := range calls {
+		if c.SessionID != "s1" || c.PageTraceID != "0000000000000001/0000000000000002" || c.PageURL != "http://localhost:8699/?q=1" || c.PagePath != "/" {
+			t.Errorf("%s: got page fields %q, %q, %q, %q, want the envelope's", c.Name, c.SessionID, c.PageTraceID, c.PageURL, c.PagePath)
+		}
+	}
+	// An entry's own fields win over the envelope's.
+	if ua := calls[0].UserAgent; ua != "Mozilla/5.0 (Envelope)" {
+		t.Errorf("/a.js: got user agent %q, want the envelope's", ua)
+	}
+	if ua := calls[1].UserAgent; ua != "Mozilla/5.0 (Entry)" {
+		t.Errorf("/b.js: got user agent %q, want the entry's", ua)
+	}
+}
+
+func TestEndpointResourceSizes(t *testing.T) {
+	c := recordPayload(t, Config{}, testPayload)
+	rs := c.resources(t)
+	if e := rs["https://cdn.example.com/app.js"]; e.TransferSize != 20480 || e.EncodedBodySize != 20000 || e.DecodedBodySize != 61000 {
+		t.Errorf("app.js: got sizes %d/%d/%d, want 20480/20000/61000", e.TransferSize, e.EncodedBodySize, e.DecodedBodySize)
+	}
+	// The font is cross-origin without Timing-Allow-Origin: the browser
+	// reports 0 for its sizes, which are unknown rather than empty.
+	if e := rs["https://fonts.example.net/font.woff2"]; e.TransferSize != -1 || e.EncodedBodySize != -1 || e.DecodedBodySize != -1 {
+		t.Errorf("font: got sizes %d/%d/%d, want -1/-1/-1 (unknown)", e.TransferSize, e.EncodedBodySize, e.DecodedBodySize)
+	}
+}
+
+// phaseDurations returns the durations of the phase spans recorded under the
+// resource span named name, by phase name.
+func phaseDurations(t *testing.T, c *captureCollector, name string) map[string]time.Duration {
+	t.Helper()
+	id, ok := c.named(name)
+	if !ok {
+		t.Fatalf("%s: not recorded", name)
+	}
+	phases := make(map[string]time.Duration)
+	for _, child := range c.children(id) {
+		var ts appdash.Timespan
+		if err := appdash.UnmarshalEvent(c.annotations(child), &ts); err != nil {
+			continue
+		}
+		s := appdash.Span{ID: child, Annotations: c.annotations(child)}
+		phases[s.Name()] = ts.End().Sub(ts.Start())
+	}
+	return phases
+}
+
+func TestEndpointNetworkPhases(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "https://example.com/a.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 90,
+		 "domainLookupStart": 10, "domainLookupEnd": 20, "connectStart": 20, "secureConnectionStart": 30,
+		 "connectEnd": 45, "requestStart": 45, "responseStart": 80, "responseEnd": 100},
+		{"name": "http://example.com/b.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 60,
+		 "domainLookupStart": 10, "domainLookupEnd": 15, "connectStart": 15, "secureConnectionStart": 0,
+		 "connectEnd": 25, "requestStart": 25, "responseStart": 60, "responseEnd": 70}
+	]`)
+	ms := func(f float64) time.Duration { return msDuration(f) }
+	for name, want := range map[string]map[string]time.Duration{
+		"https://example.com/a.js": {
+			"DNS": ms(10), "TCP": ms(25), "TLS": ms(15), "TTFB": ms(35), "Content Download": ms(20),
+		},
+		// Plain HTTP: no TLS phase.
+		"http://example.com/b.js": {
+			"DNS": ms(5), "TCP": ms(10), "TTFB": ms(35), "Content Download": ms(10),
+		},
+	} {
+		got := phaseDurations(t, c, name)
+		if len(got) != len(want) {
+			t.Errorf("%s: got phases %v, want %v", name, got, want)
+			continue
+		}
+		for phase, d := range want {
+			if got[phase] != d {
+				t.Errorf("%s: %s took %s, want %s", name, phase, got[phase], d)
+			}
+		}
+	}
+}
+
+func TestEndpointProtocol(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 1, "durationMs": 20, "protocol": "h2"},
+		{"name": "/b.js", "entryType": "resource", "startOffsetMs": 2, "durationMs": 20, "protocol": "http/1.1"},
+		{"name": "/c.js", "entryType": "resource", "startOffsetMs": 3, "durationMs": 20, "protocol": ""}
+	]`)
+	rs := c.resources(t)
+	for name, want := range map[string]string{"/a.js": "h2", "/b.js": "http/1.1", "/c.js": "unknown"} {
+		if got := rs[name].Protocol; got != want {
+			t.Errorf("%s: got protocol %q, want %q", name, got, want)
+		}
+		// Each span carries it as recorded, for queries by protocol.
+		id, _ := c.named(name)
+		var got string
+		for _, a := range c.annotations(id) {
+			if a.Key == "Resource.Protocol" {
+				got = string(a.Value)
+			}
+		}
+		if got != want {
+			t.Errorf("%s: got Resource.Protocol annotation %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestEndpointPageTraceID(t *testing.T) {
+	parent := appdash.NewRootSpanID()
+	for _, tt := range []struct{ name, target, body string }{
+		{"payload field", "/endpoint",
+			`[{"pageTraceId": "` + parent.String() + `", "name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]`},
+		{"query parameter", "/endpoint?trace=" + parent.String(),
+			`[{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]`},
+	} {
+		a, c := newTestApp(Config{})
+		if w := postPayload(a, tt.target, tt.body); w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", tt.name, w.Code, w.Body)
+		}
+		// The page load's root span is a child of the span which served
+		// the page, in its trace.
+		pages := c.withEvent("Page")
+		if len(pages) != 1 {
+			t.Fatalf("%s: got %d page spans, want 1", tt.name, len(pages))
+		}
+		if root := pages[0]; root.Trace != parent.Trace || root.Parent != parent.Span {
+			t.Errorf("%s: page load recorded as %s, want a child of %s", tt.name, root, parent)
+		}
+	}
+
+	// Without either, the page load is a trace of its own.
+	a, c := newTestApp(Config{})
+	postPayload(a, "/endpoint", `[{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}]`)
+	if pages := c.withEvent("Page"); len(pages) != 1 || !pages[0].IsRoot() {
+		t.Errorf("got page spans %v, want a single root span", pages)
+	}
+}
+
+func TestEndpointSendBeacon(t *testing.T) {
+	// navigator.sendBeacon posts a string as text/plain, and can't set
+	// headers of its own; the body is JSON all the same.
+	for _, contentType := range []string{"text/plain;charset=UTF-8", "application/x-www-form-urlencoded"} {
+		a, c := newTestApp(Config{})
+		req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		a.Endpoint(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d: %s", contentType, w.Code, http.StatusOK, w.Body)
+			continue
+		}
+		res := c.resources(t)
+		for _, name := range []string{"https://cdn.example.com/app.js", "http://localhost:8699/style.css", "https://fonts.example.net/font.woff2"} {
+			if _, ok := res[name]; !ok {
+				t.Errorf("%s: %s not recorded", contentType, name)
+			}
+		}
+	}
+
+	// The client script posts with it when the page is hidden.
+	w := httptest.NewRecorder()
+	ClientScript(w, httptest.NewRequest("GET", "/loadPerformanceData.js", nil))
+	for _, want := range []string{"navigator.sendBeacon(endpoint", `"visibilitychange"`, `document.visibilityState == "hidden"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("client script doesn't contain %s", want)
+		}
+	}
+}
+
+func TestClientScript(t *testing.T) {
+	w := httptest.NewRecorder()
+	ClientScript(w, httptest.NewRequest("GET", "/loadPerformanceData.js", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("got Content-Type %q, want text/javascript", ct)
+	}
+	if !bytes.Equal(w.Body.Bytes(), clientScript) {
+		t.Error("didn't serve loadPerformanceData.js")
+	}
+	if bytes.Contains(clientScript, []byte("console.log")) {
+		t.Error("client script logs to the console")
+	}
+
+	// The demo page loads it rather than carrying its own copy.
+	a, _ := newTestApp(Config{})
+	serveApp(t, a)
+	body := getHome(a, appdash.NewRootSpanID()).Body.String()
+	if !strings.Contains(body, `src="/loadPerformanceData.js"`) {
+		t.Error("page doesn't load /loadPerformanceData.js")
+	}
+	if strings.Contains(body, "sendBeacon") {
+		t.Error("page has an inline copy of the client script")
+	}
+
+	w = httptest.NewRecorder()
+	ClientScript(w, httptest.NewRequest("POST", "/loadPerformanceData.js", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestEndpointMethodAndContentType(t *testing.T) {
+	a, c := newTestApp(Config{})
+	for _, tt := range []struct {
+		method, contentType string
+		want                int
+	}{
+		{"POST", "application/json", http.StatusOK},
+		{"POST", "application/json; charset=utf-8", http.StatusOK},
+		{"POST", "text/plain;charset=UTF-8", http.StatusOK}, // navigator.sendBeacon
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"OPTIONS", "", http.StatusMethodNotAllowed},
+		{"POST", "application/xml", http.StatusUnsupportedMediaType},
+		{"POST", "", http.StatusUnsupportedMediaType},
+	} {
+		req := httptest.NewRequest(tt.method, "/endpoint", strings.NewReader(testPayload))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		a.Endpoint(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %q: got status %d, want %d", tt.method, tt.contentType, w.Code, tt.want)
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "POST" {
+			t.Errorf("%s: got Allow %q, want POST", tt.method, w.Header().Get("Allow"))
+		}
+	}
+	// Only the accepted posts were recorded, all into the same page load
+	// as they carry the same session ID. Deduplication is disabled.
+	if got := len(c.withEvent("Page")); got != 1 {
+		t.Errorf("got %d page loads recorded, want 1", got)
+	}
+	if got := len(c.withEvent("Resource")); got != 3*3 {
+		t.Errorf("got %d resources recorded, want %d", got, 3*3)
+	}
+}
+
+func TestEndpointJSONError(t *testing.T) {
+	for name, body := range map[string]string{
+		"truncated": `[{"name": "/a.js", "startOffsetMs": 1, "durat`,
+		"object":    `{"name": "/a.js", "startOffsetMs": 1, "durationMs": 2}`,
+	} {
+		a, _ := newTestApp(Config{})
+		w := postPayload(a, "/endpoint", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+		var e jsonError
+		if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+			t.Errorf("%s: decoding the error: %s", name, err)
+			continue
+		}
+		if e.Error == "" || e.Detail == "" {
+			t.Errorf("%s: got error %+v, want both an error and its detail", name, e)
+		}
+	}
+}
+
+func TestEndpointMaxBody(t *testing.T) {
+	a, c := newTestApp(Config{MaxBody: 64})
+	w := postPayload(a, "/endpoint", testPayload)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(c.spans) != 0 {
+		t.Errorf("recorded %d spans from a payload over the limit", len(c.spans))
+	}
+
+	// A payload at the limit is accepted.
+	a, _ = newTestApp(Config{MaxBody: int64(len(testPayload))})
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Errorf("payload at the limit: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestEndpointGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(testPayload))
+	gz.Close()
+
+	a, c := newTestApp(Config{})
+	req := httptest.NewRequest("POST", "/endpoint", &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	a.Endpoint(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// The same spans as from the uncompressed payload, relative to their
+	// own time origin.
+	plain := recordPayload(t, Config{}, testPayload)
+	if len(c.spans) != len(plain.spans) {
+		t.Errorf("got %d spans, want %d", len(c.spans), len(plain.spans))
+	}
+	got, want := c.resources(t), plain.resources(t)
+	gotOrigin, wantOrigin := pageOrigin(t, c), pageOrigin(t, plain)
+	for name, we := range want {
+		ge, ok := got[name]
+		if !ok {
+			t.Errorf("%s: not recorded", name)
+			continue
+		}
+		if ge.Start().Sub(gotOrigin) != we.Start().Sub(wantOrigin) || ge.End().Sub(ge.Start()) != we.End().Sub(we.Start()) {
+			t.Errorf("%s: got span %s+%s, want %s+%s", name,
+				ge.Start().Sub(gotOrigin), ge.End().Sub(ge.Start()), we.Start().Sub(wantOrigin), we.End().Sub(we.Start()))
+		}
+	}
+
+	// A body which isn't gzip is a bad request.
+	req = httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	a.Endpoint(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("not gzip: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEndpointMaxBodyDecompressed(t *testing.T) {
+	// A megabyte of whitespace gzips to a few kilobytes, well under the
+	// limit, but decompresses to far over it.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("["))
+	gz.Write(bytes.Repeat([]byte(" "), 1<<20))
+	gz.Write([]byte("]"))
+	gz.Close()
+	const limit = 64 << 10
+	if buf.Len() > limit {
+		t.Fatalf("compressed payload is %d bytes, want it under the %d byte limit", buf.Len(), limit)
+	}
+
+	a, _ := newTestApp(Config{MaxBody: limit})
+	req := httptest.NewRequest("POST", "/endpoint", &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	a.Endpoint(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestEndpointInitiatorType(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 100},
+		{"name": "https://img.example.com/logo.png?v=2", "entryType": "resource", "initiatorType": "img",
+		 "startOffsetMs": 10, "durationMs": 20}
+	]`)
+	id, ok := c.named("https://img.example.com/logo.png?v=2")
+	if !ok {
+		t.Fatal("image span not recorded")
+	}
+	want := map[string]string{
+		"Resource.Initiator": "img",
+		"Resource.Route":     "/logo.png",
+		"Resource.URL":       "https://img.example.com/logo.png?v=2",
+	}
+	for _, a := range c.annotations(id) {
+		if v, ok := want[a.Key]; ok {
+			if string(a.Value) != v {
+				t.Errorf("%s: got %q, want %q", a.Key, a.Value, v)
+			}
+			delete(want, a.Key)
+		}
+	}
+	for k := range want {
+		t.Errorf("%s: not recorded", k)
+	}
+}
+
+func TestRemoteCollector(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := &captureCollector{}
+	go appdash.NewServer(l, server).Start()
+
+	waitForCollector(l.Addr().String())
+	remote := appdash.NewRemoteCollector(l.Addr().String())
+	a, _ := newTestApp(Config{})
+	a.Collector = remote
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server collects what it receives asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.withEvent("Resource")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(server.withEvent("Resource")); got != 3 {
+		t.Errorf("collector server got %d resources, want 3", got)
+	}
+	if got := len(server.withEvent("Navigation")); got != 1 {
+		t.Errorf("collector server got %d navigations, want 1", got)
+	}
+}
+
+// manyResources returns a payload of a page load with n resources.
+func manyResources(n int) string {
+	var b strings.Builder
+	b.WriteString(`[{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 5000}`)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `, {"name": "/static/%d.js", "entryType": "resource", "initiatorType": "script",
+			"startOffsetMs": %d, "durationMs": 20, "requestStart": %d, "responseStart": %d, "responseEnd": %d}`,
+			i, 10+i, 12+i, 25+i, 30+i)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func TestEndpointChunked(t *testing.T) {
+	ms := appdash.NewMemoryStore()
+	chunked := appdash.NewChunkedCollector(ms)
+	chunked.MinInterval = time.Hour // flushed below only
+	defer chunked.Stop()
+	a, _ := newTestApp(Config{})
+	a.Collector = chunked
+
+	if w := postPayload(a, "/endpoint", manyResources(500)); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if err := a.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	traces, err := ms.Traces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+	if got := len(traces[0].Sub); got != 500 {
+		t.Errorf("got %d resource spans, want 500", got)
+	}
+	for _, sub := range traces[0].Sub {
+		// TTFB and Content Download.
+		if len(sub.Sub) != 2 {
+			t.Errorf("%s: got %d phase spans, want 2", sub.Span.Name(), len(sub.Sub))
+			break
+		}
+	}
+}
+
+func BenchmarkEndpoint500(b *testing.B) {
+	body := manyResources(500)
+	run := func(b *testing.B, c appdash.Collector) {
+		a, _ := newTestApp(Config{})
+		a.Collector = c
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if w := postPayload(a, "/endpoint", body); w.Code != http.StatusOK {
+				b.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+		}
+	}
+	b.Run("PerResource", func(b *testing.B) {
+		run(b, appdash.NewMemoryStore())
+	})
+	b.Run("Chunked", func(b *testing.B) {
+		chunked := appdash.NewChunkedCollector(appdash.NewMemoryStore())
+		defer chunked.Stop()
+		run(b, chunked)
+	})
+}
+
+func TestEndpointFromCache(t *testing.T) {
+	const payload = `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/fetched.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 40,
+		 "transferSize": 5300, "encodedBodySize": 5000, "decodedBodySize": 5000},
+		{"name": "/cached.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 3,
+		 "transferSize": 0, "encodedBodySize": 5000, "decodedBodySize": 5000},
+		{"name": "https://cdn.example.com/opaque-cached.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 1},
+		{"name": "https://cdn.example.com/opaque.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 80}
+	]`
+	c := recordPayload(t, Config{}, payload)
+	got := c.resources(t)
+	for name, want := range map[string]bool{
+		"/fetched.js":         false,
+		"/cached.js (cached)": true,
+		"https://cdn.example.com/opaque-cached.js (cached)": true,
+		"https://cdn.example.com/opaque.js":                 false,
+	} {
+		e, ok := got[name]
+		if !ok {
+			t.Errorf("%s: not recorded", name)
+			continue
+		}
+		if e.FromCache != want {
+			t.Errorf("%s: got FromCache %t, want %t", name, e.FromCache, want)
+		}
+	}
+	for name, want := range map[string]string{"/cached.js (cached)": "true", "/fetched.js": "false"} {
+		id, _ := c.named(name)
+		tags := make(map[string]string)
+		for _, a := range c.annotations(id) {
+			tags[a.Key] = string(a.Value)
+		}
+		if tags["Resource.FromCache"] != want {
+			t.Errorf("%s: got Resource.FromCache %q, want %q", name, tags["Resource.FromCache"], want)
+		}
+	}
+
+	// With -skip-cached the cache hits are left out.
+	c = recordPayload(t, Config{SkipCached: true}, payload)
+	if got := len(c.resources(t)); got != 2 {
+		t.Errorf("-skip-cached: got %d resources, want the 2 fetched", got)
+	}
+}
+
+func TestEndpointIncludeTypes(t *testing.T) {
+	dropped := testutil.ToFloat64(resourcesDropped.WithLabelValues("initiator_type"))
+	received := testutil.ToFloat64(resourcesReceived.WithLabelValues("beacon"))
+
+	c := recordPayload(t, Config{IncludeTypes: "script, xmlhttprequest"}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/app.js", "entryType": "resource", "initiatorType": "script", "startOffsetMs": 10, "durationMs": 40},
+		{"name": "/api/cart", "entryType": "resource", "initiatorType": "xmlhttprequest", "startOffsetMs": 60, "durationMs": 80},
+		{"name": "/logo.png", "entryType": "resource", "initiatorType": "img", "startOffsetMs": 20, "durationMs": 30},
+		{"name": "/collect", "entryType": "resource", "initiatorType": "beacon", "startOffsetMs": 150, "durationMs": 5}
+	]`)
+	got := c.resources(t)
+	if len(got) != 2 {
+		t.Errorf("got %d resources, want 2", len(got))
+	}
+	for _, name := range []string{"/app.js", "/api/cart"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s: not recorded", name)
+		}
+	}
+	// The navigation is the page itself, not a resource, so is kept.
+	if len(c.withEvent("Navigation")) != 1 {
+		t.Error("navigation not recorded")
+	}
+	// The metrics count the recorded resources only.
+	if got := testutil.ToFloat64(resourcesDropped.WithLabelValues("initiator_type")) - dropped; got != 2 {
+		t.Errorf("got %v more resources dropped, want 2", got)
+	}
+	if got := testutil.ToFloat64(resourcesReceived.WithLabelValues("beacon")) - received; got != 0 {
+		t.Errorf("got %v more beacons received, want none", got)
+	}
+}
+
+func TestEndpointOverlappingResources(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 100, "durationMs": 50},
+		{"name": "/b.js", "entryType": "resource", "startOffsetMs": 120, "durationMs": 100},
+		{"name": "/c.js", "entryType": "resource", "startOffsetMs": 300, "durationMs": 10}
+	]`)
+	origin := pageOrigin(t, c)
+	res := c.resources(t)
+	a, b, cc := res["/a.js"], res["/b.js"], res["/c.js"]
+	for name, tt := range map[string]struct {
+		e          ResourceEvent
+		start, end time.Duration
+	}{
+		"/a.js": {a, 100 * time.Millisecond, 150 * time.Millisecond},
+		"/b.js": {b, 120 * time.Millisecond, 220 * time.Millisecond},
+		"/c.js": {cc, 300 * time.Millisecond, 310 * time.Millisecond},
+	} {
+		if s, e := tt.e.Start().Sub(origin), tt.e.End().Sub(origin); s != tt.start || e != tt.end {
+			t.Errorf("%s: got span %s to %s, want %s to %s", name, s, e, tt.start, tt.end)
+		}
+	}
+	// a.js and b.js were fetched at the same time, c.js after both.
+	if !b.Start().Before(a.End()) || !a.Start().Before(b.End()) {
+		t.Error("the spans of /a.js and /b.js don't overlap")
+	}
+	if cc.Start().Before(b.End()) {
+		t.Error("the span of /c.js overlaps /b.js")
+	}
+}
+
+func TestEndpointPageEvent(t *testing.T) {
+	// From the payload.
+	c := recordPayload(t, Config{}, `[
+		{"name": "/a.js", "pageUrl": "https://shop.example.com/cart?step=2", "userAgent": "Mozilla/5.0 (Payload)",
+		 "entryType": "resource", "startOffsetMs": 10, "durationMs": 20}
+	]`)
+	var page PageEvent
+	roots := c.withEvent("Page")
+	if len(roots) != 1 {
+		t.Fatalf("got %d spans with a Page event, want 1", len(roots))
+	}
+	if !roots[0].IsRoot() {
+		t.Errorf("Page event recorded on %s, want the root span", roots[0])
+	}
+	c.event(t, roots[0], &page)
+	if page.PageURL != "https://shop.example.com/cart?step=2" || page.UserAgent != "Mozilla/5.0 (Payload)" {
+		t.Errorf("got %+v, want the page URL and user agent posted", page)
+	}
+
+	// Or else from the beacon request itself.
+	a, c := newTestApp(Config{})
+	req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(`[{"name": "/a.js", "startOffsetMs": 10, "durationMs": 20}]`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Referer", "https://shop.example.com/")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Header)")
+	a.Endpoint(httptest.NewRecorder(), req)
+	roots = c.withEvent("Page")
+	if len(roots) != 1 {
+		t.Fatalf("got %d spans with a Page event, want 1", len(roots))
+	}
+	c.event(t, roots[0], &page)
+	if page.PageURL != "https://shop.example.com/" || page.UserAgent != "Mozilla/5.0 (Header)" {
+		t.Errorf("got %+v, want the Referer and User-Agent", page)
+	}
+}
+
+func TestEndpointLogsRejectedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	a, _ := newTestApp(Config{})
+	postPayload(a, "/endpoint", `[{"name": "/a.js", "startOf`)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q: %s", buf.String(), err)
+	}
+	for k, want := range map[string]any{
+		"level":       "WARN",
+		"msg":         "decoding payload",
+		"event":       "payload_rejected",
+		"remote_addr": "192.0.2.1:1234",
+		"bytes":       float64(len(`[{"name": "/a.js", "startOf`)),
+	} {
+		if entry[k] != want {
+			t.Errorf("%s: got %v, want %v", k, entry[k], want)
+		}
+	}
+	if s, _ := entry["error"].(string); s == "" {
+		t.Error("error not logged")
+	}
+}
+
+func TestEndpointRepeatedNames(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/api/cart", "entryType": "resource", "startOffsetMs": 10, "durationMs": 30},
+		{"name": "/api/cart", "entryType": "resource", "startOffsetMs": 50, "durationMs": 30},
+		{"name": "/api/cart", "entryType": "resource", "startOffsetMs": 90, "durationMs": 30}
+	]`)
+	got := c.resources(t)
+	for _, name := range []string{"/api/cart", "/api/cart (#2)", "/api/cart (#3)"} {
+		e, ok := got[name]
+		if !ok {
+			t.Errorf("span %q not recorded", name)
+			continue
+		}
+		if e.URL != "/api/cart" {
+			t.Errorf("span %q: got URL %q, want /api/cart", name, e.URL)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d distinct spans, want 3", len(got))
+	}
+}
+
+func TestEndpointServerTiming(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/api/cart", "entryType": "resource", "startOffsetMs": 10, "durationMs": 80,
+		 "requestStart": 15, "responseStart": 70, "responseEnd": 90,
+		 "serverTiming": [{"name": "db", "duration": 32.5, "description": "cart query"}, {"name": "render", "duration": 12}]},
+		{"name": "/app.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 40}
+	]`)
+	origin := pageOrigin(t, c)
+	cart, _ := c.named("/api/cart")
+	want := map[string]struct {
+		desc     string
+		duration time.Duration
+	}{
+		"db":     {"cart query", 32500 * time.Microsecond},
+		"render": {"", 12 * time.Millisecond},
+	}
+	for _, id := range c.withEvent("ServerTiming") {
+		var e ServerTimingEvent
+		c.event(t, id, &e)
+		w, ok := want[e.Name]
+		if !ok {
+			t.Errorf("unexpected Server-Timing metric %q", e.Name)
+			continue
+		}
+		delete(want, e.Name)
+		if id.Parent != cart.Span || id.Trace != cart.Trace {
+			t.Errorf("%s: recorded under %s, want a child of /api/cart %s", e.Name, id, cart)
+		}
+		if e.Description != w.desc || e.Duration != w.duration || e.End().Sub(e.Start()) != w.duration {
+			t.Errorf("%s: got %+v, want description %q and duration %s", e.Name, e, w.desc, w.duration)
+		}
+		// Placed at the start of the request.
+		if got := e.Start().Sub(origin); got != 15*time.Millisecond {
+			t.Errorf("%s: starts %s after the time origin, want 15ms", e.Name, got)
+		}
+	}
+	for name := range want {
+		t.Errorf("Server-Timing metric %q not recorded", name)
+	}
+
+	// Resources without Server-Timing get no such spans.
+	js, _ := c.named("/app.js")
+	for _, id := range c.children(js) {
+		var e ServerTimingEvent
+		if appdash.UnmarshalEvent(c.annotations(id), &e) == nil {
+			t.Errorf("/app.js: got Server-Timing span %q", e.Name)
+		}
+	}
+}
+
+func TestEndpointDropsBadTimings(t *testing.T) {
+	dropped := testutil.ToFloat64(resourcesDropped.WithLabelValues("bad_timing"))
+	a, c := newTestApp(Config{})
+	// What JSON.stringify makes of NaN and Infinity, and a negative duration.
+	w := postPayload(a, "/endpoint", `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/ok.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20},
+		{"name": "/nan.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": null},
+		{"name": "/inf.js", "entryType": "resource", "startOffsetMs": null, "durationMs": 20},
+		{"name": "/negative.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": -5},
+		{"name": "/clamped.js", "entryType": "resource", "startOffsetMs": -3, "durationMs": 5}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp endpointResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Dropped != 3 {
+		t.Errorf("response reports %d dropped, want 3", resp.Dropped)
+	}
+	if got := testutil.ToFloat64(resourcesDropped.WithLabelValues("bad_timing")) - dropped; got != 3 {
+		t.Errorf("got %v more resources dropped for bad timings, want 3", got)
+	}
+
+	got := c.resources(t)
+	if len(got) != 2 {
+		t.Errorf("got %d resources, want 2", len(got))
+	}
+	if _, ok := got["/ok.js"]; !ok {
+		t.Error("/ok.js not recorded")
+	}
+	// A negative offset is clamped to the time origin rather than dropped.
+	if e, ok := got["/clamped.js"]; !ok {
+		t.Error("/clamped.js not recorded")
+	} else if s := e.Start().Sub(pageOrigin(t, c)); s != 0 {
+		t.Errorf("/clamped.js starts %s after the time origin, want 0", s)
+	}
+}
+
+func TestEndpointClampsTimings(t *testing.T) {
+	clamped := testutil.ToFloat64(timingsClamped)
+	dropped := testutil.ToFloat64(resourcesDropped.WithLabelValues("bad_timing"))
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/minus-one.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": -1},
+		{"name": "/nan.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": null},
+		{"name": "/ten-hours.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 36000000},
+		{"name": "/far-off.js", "entryType": "resource", "startOffsetMs": 36000000, "durationMs": 20}
+	]`)
+	if got := testutil.ToFloat64(timingsClamped) - clamped; got != 2 {
+		t.Errorf("got %v more entries with clamped timings, want 2", got)
+	}
+	if got := testutil.ToFloat64(resourcesDropped.WithLabelValues("bad_timing")) - dropped; got != 2 {
+		t.Errorf("got %v more resources dropped for bad timings, want 2", got)
+	}
+
+	origin := pageOrigin(t, c)
+	got := c.resources(t)
+	for _, name := range []string{"/minus-one.js", "/nan.js"} {
+		if _, ok := got[name]; ok {
+			t.Errorf("%s recorded, want it dropped", name)
+		}
+	}
+	maxTiming := msDuration(maxTimingMs)
+	if e, ok := got["/ten-hours.js"]; !ok {
+		t.Error("/ten-hours.js not recorded")
+	} else if d := e.End().Sub(e.Start()); d != maxTiming {
+		t.Errorf("/ten-hours.js lasts %s, want it clamped to %s", d, maxTiming)
+	}
+	if e, ok := got["/far-off.js"]; !ok {
+		t.Error("/far-off.js not recorded")
+	} else if s := e.Start().Sub(origin); s != maxTiming {
+		t.Errorf("/far-off.js starts %s after the time origin, want it clamped to %s", s, maxTiming)
+	}
+}
+
+func TestUntracedPaths(t *testing.T) {
+	a, c := newTestApp(Config{})
+	n := negroni.New()
+	n.Use(skipPaths(httptrace.Middleware(c, &httptrace.MiddlewareConfig{}), untracedPaths))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/endpoint", a.Endpoint)
+	n.UseHandler(mux)
+
+	req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	n.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/endpoint: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if got := len(c.withEvent("HTTPServer")); got != 0 {
+		t.Errorf("got %d spans of requests to untraced paths, want none", got)
+	}
+	// Only the beacon's own trace was recorded.
+	if got := len(c.withEvent("Page")); got != 1 {
+		t.Errorf("got %d page loads, want 1", got)
+	}
+
+	// The pages are traced.
+	n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := len(c.withEvent("HTTPServer")); got != 1 {
+		t.Errorf("GET /: got %d spans, want 1", got)
+	}
+}
+
+func TestResourceEventFailed(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		failed bool
+	}{
+		{0, false}, // unknown
+		{200, false},
+		{204, false},
+		{304, false},
+		{301, false},
+		{404, true},
+		{500, true},
+		{503, true},
+	} {
+		e := ResourceEvent{Status: tt.status}
+		if got := e.Failed(); got != tt.failed {
+			t.Errorf("status %d: Failed() = %t, want %t", tt.status, got, tt.failed)
+		}
+		var important bool
+		for _, k := range e.Important() {
+			important = important || k == "Resource.Status"
+		}
+		if important != tt.failed {
+			t.Errorf("status %d: Resource.Status important: %t, want %t", tt.status, important, tt.failed)
+		}
+	}
+}
+
+func TestEndpointStatus(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/ok.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20, "status": 200},
+		{"name": "/revalidated.css", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20, "status": 304,
+		 "transferSize": 300, "encodedBodySize": 1200, "decodedBodySize": 4000},
+		{"name": "/missing.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20, "status": 404,
+		 "transferSize": 500, "encodedBodySize": 150, "decodedBodySize": 150},
+		{"name": "https://cdn.example.com/opaque.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20},
+		{"name": "/unreported.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20,
+		 "transferSize": 500, "encodedBodySize": 150, "decodedBodySize": 150}
+	]`)
+	res := c.resources(t)
+	for name, want := range map[string]struct {
+		status int
+		failed bool
+		size   int64
+	}{
+		"/ok.js":           {200, false, -1},
+		"/revalidated.css": {304, false, 1200},
+		"/missing.js":      {404, true, 150},
+		// Unknown without Timing-Allow-Origin, or from browsers which
+		// don't report it, rather than assumed 200.
+		"https://cdn.example.com/opaque.js": {0, false, -1},
+		"/unreported.js":                    {0, false, 150},
+	} {
+		e, ok := res[name]
+		if !ok {
+			t.Errorf("%s: not recorded", name)
+			continue
+		}
+		if e.Status != want.status || e.Failed() != want.failed {
+			t.Errorf("%s: got status %d (failed: %t), want %d (failed: %t)", name, e.Status, e.Failed(), want.status, want.failed)
+		}
+		if e.EncodedBodySize != want.size {
+			t.Errorf("%s: got body size %d, want %d", name, e.EncodedBodySize, want.size)
+		}
+	}
+}
+
+func TestEndpointRedirect(t *testing.T) {
+	// Redirected from 10ms to 50ms, then fetched until 110ms: the browser's
+	// duration runs from the start of the redirect.
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 500},
+		{"name": "/moved.js", "entryType": "resource", "startOffsetMs": 50, "durationMs": 100,
+		 "redirectStart": 10, "redirectEnd": 50, "requestStart": 60, "responseStart": 90, "responseEnd": 110},
+		{"name": "/direct.js", "entryType": "resource", "startOffsetMs": 50, "durationMs": 60,
+		 "requestStart": 60, "responseStart": 90, "responseEnd": 110}
+	]`)
+	origin := pageOrigin(t, c)
+	res := c.resources(t)
+	moved := res["/moved.js"]
+	if s, e := moved.Start().Sub(origin), moved.End().Sub(origin); s != 10*time.Millisecond || e != 110*time.Millisecond {
+		t.Errorf("/moved.js: got span %s to %s, want 10ms to 110ms", s, e)
+	}
+	phases := phaseDurations(t, c, "/moved.js")
+	if got := phases["Redirect"]; got != 40*time.Millisecond {
+		t.Errorf("/moved.js: got Redirect phase of %s, want 40ms", got)
+	}
+	id, _ := c.named("/moved.js")
+	for _, child := range c.children(id) {
+		var ts appdash.Timespan
+		if appdash.UnmarshalEvent(c.annotations(child), &ts) == nil && (ts.Start().Before(moved.Start()) || ts.End().After(moved.End())) {
+			t.Errorf("/moved.js: phase %s lies outside the resource's span", child)
+		}
+	}
+
+	if _, ok := phaseDurations(t, c, "/direct.js")["Redirect"]; ok {
+		t.Error("/direct.js: got a Redirect phase without a redirect")
+	}
+	direct := res["/direct.js"]
+	if s, e := direct.Start().Sub(origin), direct.End().Sub(origin); s != 50*time.Millisecond || e != 110*time.Millisecond {
+		t.Errorf("/direct.js: got span %s to %s, want 50ms to 110ms", s, e)
+	}
+}
+
+func TestEndpointPaint(t *testing.T) {
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "first-paint", "entryType": "paint", "startOffsetMs": 120.5, "durationMs": 0},
+		{"name": "first-contentful-paint", "entryType": "paint", "startOffsetMs": 180, "durationMs": 0},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 100, "durationMs": 250}
+	]`)
+	origin := pageOrigin(t, c)
+	spans := c.withEvent("Paint")
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans with paint timings, want 1", len(spans))
+	}
+	if navs := c.withEvent("Navigation"); spans[0] != navs[0] {
+		t.Errorf("paint timings recorded on span %s, want the page's root span %s", spans[0], navs[0])
+	}
+	var p PaintInfo
+	c.event(t, spans[0], &p)
+	if got, want := p.FirstPaint.Sub(origin), 120500*time.Microsecond; got != want {
+		t.Errorf("got first paint at %s, want %s", got, want)
+	}
+	if got, want := p.FirstContentfulPaint.Sub(origin), 180*time.Millisecond; got != want {
+		t.Errorf("got first contentful paint at %s, want %s", got, want)
+	}
+	// The paint entries are no resources of the page.
+	if rs := c.resources(t); len(rs) != 1 {
+		t.Errorf("got %d resources, want 1: %v", len(rs), rs)
+	}
+
+	// Browsers without paint timing send no paint entries.
+	c = recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900}
+	]`)
+	if spans := c.withEvent("Paint"); len(spans) != 0 {
+		t.Errorf("got %d spans with paint timings, want none", len(spans))
+	}
+}
+
+func TestEndpointLCP(t *testing.T) {
+	// The observer reports each new largest element: the last is final. The
+	// client names the entries, which have no name, by their type.
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "largest-contentful-paint", "entryType": "largest-contentful-paint", "startOffsetMs": 300, "durationMs": 0, "element": "h1"},
+		{"name": "largest-contentful-paint", "entryType": "largest-contentful-paint", "startOffsetMs": 1250.5, "durationMs": 0,
+		 "element": "img#hero", "url": "https://example.com/hero.jpg"}
+	]`)
+	spans := c.withEvent("LCP")
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans with an LCP, want 1", len(spans))
+	}
+	if navs := c.withEvent("Navigation"); spans[0] != navs[0] {
+		t.Errorf("LCP recorded on span %s, want the page's root span %s", spans[0], navs[0])
+	}
+	var e LCPEvent
+	c.event(t, spans[0], &e)
+	if want := 1250500 * time.Microsecond; e.LCP != want {
+		t.Errorf("got LCP %s, want %s", e.LCP, want)
+	}
+	if e.Element != "img#hero" || e.URL != "https://example.com/hero.jpg" {
+		t.Errorf("got LCP element %q showing %q, want img#hero showing https://example.com/hero.jpg", e.Element, e.URL)
+	}
+}
+
+func TestEndpointWebVitalsReportedAlone(t *testing.T) {
+	const nav = `{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900}`
+
+	// A page load reporting only its LCP has no CLS recorded.
+	c := recordPayload(t, Config{}, `[`+nav+`,
+		{"name": "largest-contentful-paint", "entryType": "largest-contentful-paint", "startOffsetMs": 300, "durationMs": 0}
+	]`)
+	if n := len(c.withEvent("LCP")); n != 1 {
+		t.Errorf("LCP only: got %d LCPs recorded, want 1", n)
+	}
+	if n := len(c.withEvent("CLS")); n != 0 {
+		t.Errorf("LCP only: got %d CLS scores recorded, want none", n)
+	}
+
+	// A page load reporting only its CLS has no LCP recorded, and a score
+	// of 0 is recorded.
+	c = recordPayload(t, Config{}, `[`+nav+`,
+		{"name": "layout-shift", "entryType": "layout-shift", "startOffsetMs": 0, "durationMs": 0, "value": 0}
+	]`)
+	if n := len(c.withEvent("LCP")); n != 0 {
+		t.Errorf("CLS only: got %d LCPs recorded, want none", n)
+	}
+	spans := c.withEvent("CLS")
+	if len(spans) != 1 {
+		t.Fatalf("CLS only: got %d CLS scores recorded, want 1", len(spans))
+	}
+	var e CLSEvent
+	c.event(t, spans[0], &e)
+	if e.CLS != 0 {
+		t.Errorf("got CLS %v, want 0", e.CLS)
+	}
+	recorded := false
+	for _, an := range c.annotations(spans[0]) {
+		recorded = recorded || an.Key == "WebVitals.CLS"
+	}
+	if !recorded {
+		t.Error("a CLS of 0 was not recorded")
+	}
+
+	c = recordPayload(t, Config{}, `[`+nav+`,
+		{"name": "layout-shift", "entryType": "layout-shift", "startOffsetMs": 2000, "durationMs": 0, "value": 0.125}
+	]`)
+	spans = c.withEvent("CLS")
+	if len(spans) != 1 {
+		t.Fatalf("got %d CLS scores recorded, want 1", len(spans))
+	}
+	c.event(t, spans[0], &e)
+	if e.CLS != 0.125 {
+		t.Errorf("got CLS %v, want 0.125", e.CLS)
+	}
+}
+
+func TestEndpointOpaqueTiming(t *testing.T) {
+	// The cross-origin font and image were served without
+	// Timing-Allow-Origin: their milestones are all 0.
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "/app.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 90,
+		 "domainLookupStart": 10, "domainLookupEnd": 10, "connectStart": 10, "connectEnd": 10,
+		 "requestStart": 20, "responseStart": 60, "responseEnd": 100},
+		{"name": "https://fonts.example.net/font.woff2", "entryType": "resource", "startOffsetMs": 120, "durationMs": 60,
+		 "domainLookupStart": 0, "domainLookupEnd": 0, "connectStart": 0, "connectEnd": 0,
+		 "requestStart": 0, "responseStart": 0, "responseEnd": 180},
+		{"name": "https://img.example.net/a.png", "entryType": "resource", "startOffsetMs": 130, "durationMs": 20}
+	]`)
+	res := c.resources(t)
+	for name, opaque := range map[string]bool{
+		"/app.js":                              false,
+		"https://fonts.example.net/font.woff2": true,
+		"https://img.example.net/a.png":        true,
+	} {
+		e, ok := res[name]
+		if !ok {
+			t.Errorf("%s: not recorded", name)
+			continue
+		}
+		if e.OpaqueTiming != opaque {
+			t.Errorf("%s: got OpaqueTiming %v, want %v", name, e.OpaqueTiming, opaque)
+		}
+		if e.Duration <= 0 {
+			t.Errorf("%s: got duration %s, want the total duration", name, e.Duration)
+		}
+		phases := phaseDurations(t, c, name)
+		switch {
+		case opaque && len(phases) != 0:
+			t.Errorf("%s: got phases %v, want a single coarse span", name, phases)
+		case !opaque && (phases["TTFB"] != 40*time.Millisecond || phases["Content Download"] != 40*time.Millisecond):
+			t.Errorf("%s: got phases %v, want TTFB and Content Download of 40ms", name, phases)
+		}
+	}
+	if got := res["https://fonts.example.net/font.woff2"].Duration; got != 60*time.Millisecond {
+		t.Errorf("font: got duration %s, want 60ms", got)
+	}
+}
+
+func TestUIBase(t *testing.T) {
+	for _, tt := range []struct {
+		s, addr string
+		tls     bool
+		want    string
+	}{
+		// The defaults: traceapp.New requires an absolute URL.
+		{"", ":8700", false, "http://localhost:8700/"},
+		{"", ":8700", true, "https://localhost:8700/"},
+		{"", "127.0.0.1:7700", false, "http://127.0.0.1:7700/"},
+		{"https://rum.example.com/appdash", ":8700", false, "https://rum.example.com/appdash/"},
+		{"https://rum.example.com/appdash/", ":8700", false, "https://rum.example.com/appdash/"},
+		{"https://rum.example.com", ":8700", false, "https://rum.example.com/"},
+	} {
+		base := uiBase(tt.s, tt.addr, tt.tls)
+		if !base.IsAbs() || base.Host == "" {
+			t.Errorf("%q, %q: got %q, want an absolute URL", tt.s, tt.addr, base)
+		}
+		if got := base.String(); got != tt.want {
+			t.Errorf("%q, %q: got %q, want %q", tt.s, tt.addr, got, tt.want)
+		}
+		// The UI's links resolve under the prefix.
+		if got, want := base.ResolveReference(&url.URL{Path: "traces"}).String(), tt.want+"traces"; got != want {
+			t.Errorf("%q, %q: traces link resolves to %q, want %q", tt.s, tt.addr, got, want)
+		}
+	}
+}
+
+func TestEndpointFetchOrder(t *testing.T) {
+	// Posted out of the order they were fetched in, as a batch of several
+	// PerformanceObserver callbacks may be.
+	c := recordPayload(t, Config{}, `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900},
+		{"name": "/c.js", "entryType": "resource", "startOffsetMs": 300, "durationMs": 10},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 200.5, "durationMs": 10},
+		{"name": "/a.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 10},
+		{"name": "/b.js", "entryType": "resource", "startOffsetMs": 150, "durationMs": 10}
+	]`)
+	origin := pageOrigin(t, c)
+	type span struct {
+		name  string
+		start time.Duration
+	}
+	var got []span
+	for name, e := range c.resources(t) {
+		got = append(got, span{name, e.Start().Sub(origin)})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].start < got[j].start })
+	want := []span{
+		{"/a.js", 10 * time.Millisecond},
+		{"/b.js", 150 * time.Millisecond},
+		// The repeat is numbered in fetch order, not posting order.
+		{"/a.js (#2)", 200500 * time.Microsecond},
+		{"/c.js", 300 * time.Millisecond},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got spans %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got spans %v, want %v", got, want)
+			break
+		}
+	}
+
+	// The spans were recorded in fetch order too.
+	var recorded []string
+	for _, id := range c.withEvent("Resource") {
+		recorded = append(recorded, (&appdash.Span{ID: id, Annotations: c.annotations(id)}).Name())
+	}
+	if strings.Join(recorded, " ") != "/a.js /b.js /a.js (#2) /c.js" {
+		t.Errorf("got spans recorded in order %q, want fetch order", recorded)
+	}
+}
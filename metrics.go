@@ -0,0 +1,66 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Prometheus metrics about the resource timings ingested by Endpoint, served
+// on /metrics.
+var (
+	resourceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "loadtimes",
+		Name:      "resource_duration_seconds",
+		Help:      "Load duration of browser resources, by initiator type.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"initiator_type"})
+
+	resourcesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "resources_received_total",
+		Help:      "Number of browser resource entries received, by initiator type.",
+	}, []string{"initiator_type"})
+
+	resourceBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "resource_transfer_bytes_total",
+		Help:      "Bytes transferred to load browser resources (the total page weight), by initiator type. Resources of unknown size are not counted.",
+	}, []string{"initiator_type"})
+
+	resourcesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "resources_dropped_total",
+		Help:      "Number of browser resource entries received but not recorded, by reason (initiator_type for -include-types, cached for -skip-cached, bad_timing for NaN, infinite or null timings and negative durations).",
+	}, []string{"reason"})
+
+	payloadsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "payloads_rejected_total",
+		Help:      "Number of payloads rejected by /endpoint, by reason.",
+	}, []string{"reason"})
+
+	timingsClamped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "timings_clamped_total",
+		Help:      "Number of browser entries recorded with negative offsets, or implausibly large offsets or durations, clamped.",
+	})
+
+	collectErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "collect_errors_total",
+		Help:      "Number of errors recording spans: payloads posted to /endpoint whose spans could not all be recorded, or with -flush-interval, flushes of the buffered spans which failed.",
+	})
+
+	payloadsDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "payloads_deduplicated_total",
+		Help:      "Number of payloads posted to /endpoint again within -dedupe-window, and so not recorded again.",
+	})
+
+	payloadsSampledOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loadtimes",
+		Name:      "payloads_sampled_out_total",
+		Help:      "Number of valid payloads posted to /endpoint but not recorded because of -sample-rate.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(resourceDuration, resourcesReceived, resourceBytes, resourcesDropped, timingsClamped, payloadsRejected, payloadsSampledOut, payloadsDeduplicated, collectErrors)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogram returns the sample count and sum observed by the resource
+// duration histogram for initiatorType, and its bucket counts by upper bound.
+func histogram(t *testing.T, initiatorType string) (count uint64, sum float64, buckets map[float64]uint64) {
+	t.Helper()
+	var m dto.Metric
+	if err := resourceDuration.WithLabelValues(initiatorType).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	buckets = make(map[float64]uint64)
+	for _, b := range m.Histogram.Bucket {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum(), buckets
+}
+
+func TestEndpointMetrics(t *testing.T) {
+	received := testutil.ToFloat64(resourcesReceived.WithLabelValues("img"))
+	bytes := testutil.ToFloat64(resourceBytes.WithLabelValues("img"))
+	count, sum, buckets := histogram(t, "img")
+
+	// Two images, one of them of unknown size.
+	a, _ := newTestApp(Config{})
+	w := postPayload(a, "/endpoint", `[
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 1000},
+		{"name": "/a.png", "entryType": "resource", "initiatorType": "img", "startOffsetMs": 10, "durationMs": 40,
+		 "transferSize": 5000, "encodedBodySize": 4700, "decodedBodySize": 4700},
+		{"name": "https://cdn.example.com/b.png", "entryType": "resource", "initiatorType": "img", "startOffsetMs": 20, "durationMs": 1500}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	if got := testutil.ToFloat64(resourcesReceived.WithLabelValues("img")) - received; got != 2 {
+		t.Errorf("resources received: got %v more, want 2", got)
+	}
+	if got := testutil.ToFloat64(resourceBytes.WithLabelValues("img")) - bytes; got != 5000 {
+		t.Errorf("transfer bytes: got %v more, want 5000", got)
+	}
+	newCount, newSum, newBuckets := histogram(t, "img")
+	if got := newCount - count; got != 2 {
+		t.Errorf("durations observed: got %d more, want 2", got)
+	}
+	if got := newSum - sum; math.Abs(got-1.54) > 1e-9 {
+		t.Errorf("duration sum: got %vs more, want 1.54s", got)
+	}
+	for le, want := range map[float64]uint64{.025: 0, .05: 1, 1: 1, 2.5: 2, 10: 2} {
+		if got := newBuckets[le] - buckets[le]; got != want {
+			t.Errorf("bucket le=%v: got %d more, want %d", le, got, want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "sourcegraph.com/sourcegraph/appdash"
+
+// MultiCollector is an appdash.Collector which sends every span to each of
+// several collectors, e.g. to both the Appdash store and OTLP, or to a
+// capturing fake alongside the real one.
+type MultiCollector []appdash.Collector
+
+// Collect implements the appdash.Collector interface. A collector failing
+// doesn't keep the span from the others; the first error is returned.
+func (mc MultiCollector) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	var firstErr error
+	for _, c := range mc {
+		if err := c.Collect(id, as...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+func TestMultiCollector(t *testing.T) {
+	errFull := errors.New("store full")
+	first, failing, last := &captureCollector{}, &captureCollector{err: errFull}, &captureCollector{}
+	mc := MultiCollector{first, failing, last}
+
+	id := appdash.NewRootSpanID()
+	err := mc.Collect(id, appdash.Annotation{Key: "Name", Value: []byte("/a.js")})
+	if err != errFull {
+		t.Errorf("got error %v, want %v", err, errFull)
+	}
+	// The sinks on either side of the failing one still get the span.
+	for name, c := range map[string]*captureCollector{"first": first, "last": last} {
+		if len(c.annotations(id)) != 1 {
+			t.Errorf("%s collector: got %d annotations, want 1", name, len(c.annotations(id)))
+		}
+	}
+
+	// Once it recovers, nothing is reported.
+	failing.err = nil
+	if err := mc.Collect(appdash.NewRootSpanID()); err != nil {
+		t.Errorf("no failing collector: got error %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"sourcegraph.com/sourcegraph/appdash"
+	"sourcegraph.com/sourcegraph/appdash/httptrace"
+)
+
+// otlpCollector is an appdash.Collector which, instead of storing spans,
+// exports them as OpenTelemetry spans over OTLP (gRPC), e.g. to an
+// OpenTelemetry Collector.
+//
+// The OTel spans keep the IDs of the appdash spans they are made from, so the
+// page root, resources and network phases keep their parent/child
+// relationships, even across the several beacons of a page load.
+//
+// An appdash span may be collected in several Collect calls (e.g. its name
+// and its events separately, or the page root once per beacon), whereas an
+// OTel span is exported once and for all. So the annotations of each span are
+// held back until the event with its timespan arrives, and the span is
+// exported then with all of them; annotations which never get a timespan are
+// dropped after otlpPendingAge.
+type otlpCollector struct {
+	tp     *sdktrace.TracerProvider
+	tracer trace.Tracer
+
+	mu      sync.Mutex
+	pending map[appdash.SpanID]*pendingSpan
+}
+
+// pendingSpan holds the annotations of a span not exported yet.
+type pendingSpan struct {
+	as        appdash.Annotations
+	firstSeen time.Time
+}
+
+// otlpPendingAge is how long the annotations of a span without a timespan
+// are held back, waiting for one. The beacons of a page load normally arrive
+// within seconds of each other.
+const otlpPendingAge = 10 * time.Minute
+
+// newOTLPCollector returns a collector exporting to the OTLP endpoint
+// (host:port) over an insecure gRPC connection.
+func newOTLPCollector(ctx context.Context, endpoint string) (*otlpCollector, error) {
+	exp, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newOTelCollector(exp), nil
+}
+
+// newOTelCollector returns a collector exporting with exp.
+func newOTelCollector(exp sdktrace.SpanExporter) *otlpCollector {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithIDGenerator(appdashIDs{}),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "loadtimes"))),
+	)
+	return &otlpCollector{
+		tp:      tp,
+		tracer:  tp.Tracer("github.com/nandakola/loadtimes"),
+		pending: make(map[appdash.SpanID]*pendingSpan),
+	}
+}
+
+// Collect implements the appdash.Collector interface, exporting the span
+// described by as together with the annotations held back for it, or holding
+// as back too if there is no timespan among them yet.
+func (c *otlpCollector) Collect(id appdash.SpanID, as ...appdash.Annotation) error {
+	now := time.Now()
+	c.mu.Lock()
+	c.expire(now)
+	p, ok := c.pending[id]
+	if !ok {
+		p = &pendingSpan{firstSeen: now}
+	}
+	p.as = append(p.as, as...)
+	start, end, attrs, ok := otlpSpanData(p.as)
+	if !ok {
+		c.pending[id] = p
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.pending, id)
+	c.mu.Unlock()
+
+	var name appdash.SpanNameEvent
+	appdash.UnmarshalEvent(p.as, &name)
+
+	ctx := context.WithValue(context.Background(), spanIDKey{}, id)
+	if !id.IsRoot() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    otelTraceID(id.Trace),
+			SpanID:     otelSpanID(id.Parent),
+			TraceFlags: trace.FlagsSampled,
+			Remote:     true,
+		}))
+	}
+	_, span := c.tracer.Start(ctx, name.Name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	span.End(trace.WithTimestamp(end))
+	return nil
+}
+
+// expire drops the annotations held back since otlpPendingAge before now.
+// The caller must hold c.mu.
+func (c *otlpCollector) expire(now time.Time) {
+	for id, p := range c.pending {
+		if now.Sub(p.firstSeen) > otlpPendingAge {
+			delete(c.pending, id)
+		}
+	}
+}
+
+// Flush exports the spans buffered so far.
+func (c *otlpCollector) Flush() error {
+	return c.tp.ForceFlush(context.Background())
+}
+
+// Shutdown exports the spans still buffered and stops the exporter.
+func (c *otlpCollector) Shutdown(ctx context.Context) error {
+	return c.tp.Shutdown(ctx)
+}
+
+// otlpSpanData returns the start and end times and the OTel attributes of
+// the span described by as, from the events recorded on it, or false if
+// there is no event with a timespan among them.
+func otlpSpanData(as appdash.Annotations) (start, end time.Time, attrs []attribute.KeyValue, ok bool) {
+	var (
+		res  ResourceEvent
+		nav  NavigationEvent
+		st   ServerTimingEvent
+		srv  httptrace.ServerEvent
+		span appdash.Timespan
+	)
+	switch {
+	case appdash.UnmarshalEvent(as, &res) == nil:
+		return res.Start(), res.End(), []attribute.KeyValue{
+			attribute.String("http.url", res.URL),
+			attribute.String("resource.initiator_type", res.InitiatorType),
+			attribute.String("network.protocol.name", res.Protocol),
+			attribute.Int64("resource.transfer_size", res.TransferSize),
+			attribute.Int64("resource.encoded_body_size", res.EncodedBodySize),
+			attribute.Int64("resource.decoded_body_size", res.DecodedBodySize),
+			attribute.Int("http.status_code", res.Status),
+		}, true
+	case appdash.UnmarshalEvent(as, &nav) == nil:
+		return nav.Start(), nav.End(), []attribute.KeyValue{
+			attribute.String("http.url", nav.URL),
+			attribute.String("user_agent.original", nav.Client.UserAgent),
+		}, true
+	case appdash.UnmarshalEvent(as, &st) == nil:
+		return st.Start(), st.End(), []attribute.KeyValue{
+			attribute.String("server_timing.name", st.Name),
+			attribute.String("server_timing.description", st.Description),
+		}, true
+	case appdash.UnmarshalEvent(as, &srv) == nil:
+		return srv.Start(), srv.End(), []attribute.KeyValue{
+			attribute.String("http.route", srv.Route),
+			attribute.Int("http.status_code", srv.Response.StatusCode),
+		}, true
+	case appdash.UnmarshalEvent(as, &span) == nil:
+		return span.Start(), span.End(), nil, true
+	}
+	return time.Time{}, time.Time{}, nil, false
+}
+
+// spanIDKey is the context key under which otlpCollector passes the appdash
+// span ID of the span being started to appdashIDs.
+type spanIDKey struct{}
+
+// appdashIDs is an OTel ID generator which gives spans the IDs of the appdash
+// spans they are made from, falling back to random IDs.
+type appdashIDs struct{}
+
+// NewIDs implements the sdktrace.IDGenerator interface.
+func (appdashIDs) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if id, ok := ctx.Value(spanIDKey{}).(appdash.SpanID); ok {
+		return otelTraceID(id.Trace), otelSpanID(id.Span)
+	}
+	var tid trace.TraceID
+	rand.Read(tid[:])
+	return tid, appdashIDs{}.NewSpanID(ctx, tid)
+}
+
+// NewSpanID implements the sdktrace.IDGenerator interface.
+func (appdashIDs) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	if id, ok := ctx.Value(spanIDKey{}).(appdash.SpanID); ok {
+		return otelSpanID(id.Span)
+	}
+	var sid trace.SpanID
+	rand.Read(sid[:])
+	return sid
+}
+
+// otelTraceID converts an appdash trace ID to an OTel one, which is twice as
+// long.
+func otelTraceID(id appdash.ID) trace.TraceID {
+	var tid trace.TraceID
+	binary.BigEndian.PutUint64(tid[8:], uint64(id))
+	return tid
+}
+
+// otelSpanID converts an appdash span ID to an OTel one.
+func otelSpanID(id appdash.ID) trace.SpanID {
+	var sid trace.SpanID
+	binary.BigEndian.PutUint64(sid[:], uint64(id))
+	return sid
+}
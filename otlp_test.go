@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// exportedSpans flushes c and returns the spans exported to exp, failing the
+// test if any was exported more than once.
+func exportedSpans(t *testing.T, c *otlpCollector, exp *tracetest.InMemoryExporter) tracetest.SpanStubs {
+	t.Helper()
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	spans := exp.GetSpans()
+	seen := make(map[trace.SpanID]bool)
+	for _, s := range spans {
+		if id := s.SpanContext.SpanID(); seen[id] {
+			t.Errorf("span %q (%s) exported more than once", s.Name, id)
+		} else {
+			seen[id] = true
+		}
+	}
+	return spans
+}
+
+// spanNamed returns the first of spans named name, or false if there is none.
+func spanNamed(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+// attr returns the value of the attribute key of s.
+func attr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestOTLPCollector(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	c := newOTelCollector(exp)
+	a, _ := newTestApp(Config{})
+	a.Collector = c
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	spans := exportedSpans(t, c, exp)
+
+	// The root, the three resources and their seven network phases.
+	if len(spans) != 1+3+7 {
+		t.Errorf("got %d spans, want %d", len(spans), 1+3+7)
+	}
+	root, ok := spanNamed(spans, "http://localhost:8699/")
+	if !ok {
+		t.Fatal("page root not exported")
+	}
+	if root.Parent.IsValid() {
+		t.Errorf("page root has parent %s", root.Parent.SpanID())
+	}
+	if got, want := root.EndTime.Sub(root.StartTime), 480500*time.Microsecond; got != want {
+		t.Errorf("page root lasts %s, want %s", got, want)
+	}
+
+	js, ok := spanNamed(spans, "https://cdn.example.com/app.js")
+	if !ok {
+		t.Fatal("app.js not exported")
+	}
+	if js.Parent.SpanID() != root.SpanContext.SpanID() || js.SpanContext.TraceID() != root.SpanContext.TraceID() {
+		t.Errorf("app.js is a child of %s, want the page root %s", js.Parent.SpanID(), root.SpanContext.SpanID())
+	}
+	if got, want := js.StartTime.Sub(root.StartTime), 130250*time.Microsecond; got != want {
+		t.Errorf("app.js starts %s after the page, want %s", got, want)
+	}
+	for key, want := range map[attribute.Key]attribute.Value{
+		"resource.initiator_type":    attribute.StringValue("script"),
+		"network.protocol.name":      attribute.StringValue("h2"),
+		"resource.transfer_size":     attribute.Int64Value(20480),
+		"resource.encoded_body_size": attribute.Int64Value(20000),
+		"resource.decoded_body_size": attribute.Int64Value(61000),
+		"http.status_code":           attribute.IntValue(200),
+	} {
+		if got := attr(js, key); got != want {
+			t.Errorf("app.js %s: got %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+
+	var phases int
+	for _, s := range spans {
+		if s.Parent.SpanID() == js.SpanContext.SpanID() {
+			phases++
+			if s.StartTime.Before(js.StartTime) || s.EndTime.After(js.EndTime) {
+				t.Errorf("phase %q lies outside app.js", s.Name)
+			}
+		}
+	}
+	if phases != 5 {
+		t.Errorf("got %d phases of app.js, want 5", phases)
+	}
+}
+
+func TestOTLPCollectorMergesAnnotations(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	c := newOTelCollector(exp)
+	start := time.Now().Add(-time.Minute)
+	root := appdash.NewRootSpanID()
+
+	// The page root's Page event arrives on its own, with no timespan: it
+	// isn't exported until the navigation does.
+	rec := appdash.NewRecorder(root, c)
+	rec.Name("/home")
+	rec.Event(&PageEvent{PageURL: "https://shop.example.com/home"})
+	if spans := exportedSpans(t, c, exp); len(spans) != 0 {
+		t.Errorf("got %d spans exported without a timespan, want none", len(spans))
+	}
+
+	rec.Event(&NavigationEvent{URL: "https://shop.example.com/home", NavigationStart: start, LoadEventEnd: start.Add(time.Second)})
+	spans := exportedSpans(t, c, exp)
+	s, ok := spanNamed(spans, "/home")
+	if !ok || len(spans) != 1 {
+		t.Fatalf("got spans %v, want the page root named after the earlier annotation", spans)
+	}
+	if !s.StartTime.Equal(start) || !s.EndTime.Equal(start.Add(time.Second)) {
+		t.Errorf("got span %s to %s, want %s to %s", s.StartTime, s.EndTime, start, start.Add(time.Second))
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("%d spans still pending after the export", len(c.pending))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateClientIdle is how long a client must have been quiet for its rate
+// limiter to be forgotten. Its bucket has long been full again by then, so
+// forgetting it changes nothing.
+const rateClientIdle = 10 * time.Minute
+
+// rateLimiter limits the rate of requests of each client IP with a token
+// bucket, so that a single misbehaving page posting beacons in a loop can't
+// overwhelm the collector.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+// rateClient is the token bucket of one client IP.
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns a limiter allowing each client limit requests per
+// second, in bursts of up to burst requests.
+func newRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		burst:   burst,
+		clients: make(map[string]*rateClient),
+	}
+}
+
+// allow reports whether the client ip may make a request at now, or else how
+// long it has to wait before it may.
+func (rl *rateLimiter) allow(ip string, now time.Time) (ok bool, retryAfter time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > rateClientIdle {
+		rl.sweep(now)
+	}
+	c, ok := rl.clients[ip]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = c
+	}
+	c.lastSeen = now
+
+	r := c.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, rateClientIdle // burst is 0: never allowed
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// sweep forgets the clients idle for longer than rateClientIdle. The caller
+// must hold rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for ip, c := range rl.clients {
+		if now.Sub(c.lastSeen) > rateClientIdle {
+			delete(rl.clients, ip)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// rateLimit wraps the handler next with a.RateLimiter, replying 429 Too Many
+// Requests to clients over their limit. It returns next unchanged if rate
+// limiting is disabled.
+//
+// Clients are told apart by the address they connect from: unlike
+// X-Forwarded-For, it can't be forged to escape the limit.
+func (a *App) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	if a.RateLimiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, retryAfter := a.RateLimiter.allow(ip, time.Now()); !ok {
+			payloadsRejected.WithLabelValues("rate_limited").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "too many requests", "retry after "+retryAfter.Round(time.Millisecond).String())
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimit(t *testing.T) {
+	a, _ := newTestApp(Config{RateLimit: 1, RateBurst: 2})
+	h := a.rateLimit(a.Endpoint)
+	post := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/endpoint", strings.NewReader(testPayload))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	rejected := testutil.ToFloat64(payloadsRejected.WithLabelValues("rate_limited"))
+
+	// The burst goes through, whichever port the client posts from.
+	for i, addr := range []string{"192.0.2.1:1000", "192.0.2.1:1001"} {
+		if w := post(addr); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("post %d: rate limited within the burst", i)
+		}
+	}
+	w := post("192.0.2.1:1002")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d over the limit, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want \"1\"", got)
+	}
+	if got := testutil.ToFloat64(payloadsRejected.WithLabelValues("rate_limited")) - rejected; got != 1 {
+		t.Errorf("got %v payloads rejected for their rate, want 1", got)
+	}
+
+	// Other clients have buckets of their own.
+	if w := post("198.51.100.7:1000"); w.Code == http.StatusTooManyRequests {
+		t.Error("another client was rate limited")
+	}
+
+	// Without a limit, the handler is left alone.
+	a, _ = newTestApp(Config{})
+	if a.RateLimiter != nil {
+		t.Error("got a rate limiter with no -rate-limit")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	rl := newRateLimiter(2, 1)
+	now := time.Now()
+	if ok, _ := rl.allow("192.0.2.1", now); !ok {
+		t.Fatal("first request not allowed")
+	}
+	ok, retryAfter := rl.allow("192.0.2.1", now)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("got %v, retry after %s, want false, retry after 500ms", ok, retryAfter)
+	}
+	if ok, _ := rl.allow("192.0.2.1", now.Add(500*time.Millisecond)); !ok {
+		t.Error("request not allowed once the bucket refilled")
+	}
+
+	// Idle clients are forgotten.
+	rl.allow("192.0.2.2", now.Add(2*rateClientIdle))
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.clients["192.0.2.1"]; ok {
+		t.Error("idle client kept")
+	}
+}
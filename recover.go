@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/codegangsta/negroni"
+	gcontext "github.com/gorilla/context"
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// maxPanicStack is how much of the stack of a panic, in bytes, is recorded
+// in its PanicEvent.
+const maxPanicStack = 4096
+
+// PanicEvent records a panic while serving a request, with the recovered
+// value and the (truncated) stack of the goroutine which panicked.
+type PanicEvent struct {
+	Value string `trace:"Panic.Value"`
+	Stack string `trace:"Panic.Stack"`
+}
+
+// Schema returns the constant "Panic".
+func (PanicEvent) Schema() string { return "Panic" }
+
+// Important implements the appdash ImportantEvent.
+func (PanicEvent) Important() []string {
+	return []string{"Panic.Value"}
+}
+
+// recoverPanics returns a Negroni middleware which recovers from panics in
+// the handlers after it, records a PanicEvent into c and replies 500. The
+// event goes on the request's span (see CtxSpanID) so that the failed
+// request shows up in the Appdash UI, or on a new trace of its own for the
+// requests which aren't traced.
+func recoverPanics(c appdash.Collector) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Meant to abort the response, not a bug.
+				panic(v)
+			}
+			stack := debug.Stack()
+			if len(stack) > maxPanicStack {
+				stack = stack[:maxPanicStack]
+			}
+
+			span, traced := gcontext.Get(r, CtxSpanID).(appdash.SpanID)
+			if !traced {
+				span = appdash.NewRootSpanID()
+			}
+			rec := appdash.NewRecorder(span, c)
+			if !traced {
+				rec.Name(r.URL.Path)
+			}
+			rec.Event(PanicEvent{Value: fmt.Sprint(v), Stack: string(stack)})
+			rec.Finish()
+
+			slog.Error("panic serving request", "trace_id", span.Trace.String(), "path", r.URL.Path, "panic", v)
+			writeJSONError(w, http.StatusInternalServerError, "internal server error", "")
+		}()
+		next(w, r)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// sampler decides which of the page loads posting to Endpoint are recorded,
+// when only a fraction of them are (-sample-rate). The decision is made from
+// a hash of the page's session ID, so that it is the same for every batch
+// the page posts. Payloads without a session ID are sampled at random.
+type sampler struct {
+	rate float64
+
+	mu  sync.Mutex // guards rnd, which isn't safe for concurrent use
+	rnd *rand.Rand
+}
+
+// newSampler returns a sampler keeping a fraction rate of the page loads.
+func newSampler(rate float64) *sampler {
+	return &sampler{rate: rate, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// sample reports whether to record the payload of the page session
+// sessionID.
+func (s *sampler) sample(sessionID string) bool {
+	if s.rate <= 0 {
+		return false
+	}
+	if sessionID != "" {
+		// SHA-256 spreads even similar IDs (such as "session-1" and
+		// "session-2") uniformly, so that a fraction rate of the sessions
+		// is kept, and always gives the same ID the same decision. Its
+		// top 53 bits are taken as a float64 in [0, 1).
+		sum := sha256.Sum256([]byte(sessionID))
+		return float64(binary.BigEndian.Uint64(sum[:8])>>11)/(1<<53) < s.rate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rnd.Float64() < s.rate
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEndpointSampling(t *testing.T) {
+	sampledOut := testutil.ToFloat64(payloadsSampledOut)
+
+	a, c := newTestApp(Config{SampleRate: configSampleRate(0)})
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusNoContent {
+		t.Errorf("rate 0: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if len(c.spans) != 0 {
+		t.Errorf("rate 0: got %d spans recorded, want none", len(c.spans))
+	}
+	if got := testutil.ToFloat64(payloadsSampledOut) - sampledOut; got != 1 {
+		t.Errorf("rate 0: got %v more payloads sampled out, want 1", got)
+	}
+
+	a, c = newTestApp(Config{SampleRate: 1})
+	if a.Sampler != nil {
+		t.Error("rate 1: got a sampler, want every payload recorded")
+	}
+	if w := postPayload(a, "/endpoint", testPayload); w.Code != http.StatusOK {
+		t.Errorf("rate 1: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := len(c.withEvent("Resource")); got != 3 {
+		t.Errorf("rate 1: got %d resources recorded, want 3", got)
+	}
+}
+
+func TestSamplerBySession(t *testing.T) {
+	s := newSampler(0.5)
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		first := s.sample(session)
+		// Every batch of a page load gets the same decision.
+		for j := 0; j < 3; j++ {
+			if s.sample(session) != first {
+				t.Fatalf("%s: sampled differently across batches", session)
+			}
+		}
+		if first {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("kept %d of 1000 page loads at rate 0.5", kept)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// pageSession is the trace a single page load records its beacons into.
+type pageSession struct {
+	// Root is the root span of the page load's trace.
+	Root appdash.SpanID
+
+	// Origin anchors the page's time origin, against which all of the
+	// browser's timings are relative. It is fixed when the first beacon of
+	// the page load arrives so that later batches line up with earlier ones.
+	// See payloadOrigin.
+	Origin time.Time
+
+	// First is set on the session returned for the page load's first
+	// beacon only, i.e. when the session was just started.
+	First bool
+
+	lastSeen time.Time
+}
+
+// newPageSession starts a page session with the given time origin, under
+// parent if non-nil.
+func newPageSession(parent *appdash.SpanID, origin time.Time) pageSession {
+	root := appdash.NewRootSpanID()
+	if parent != nil {
+		root = appdash.NewSpanID(*parent)
+	}
+	return pageSession{Root: root, Origin: origin, First: true}
+}
+
+// sessionRegistry maps the session ID a page sends with each of its beacons
+// to the page load's trace, so that a page posting its resource timings in
+// several batches ends up with a single trace rather than one per batch.
+// Sessions not seen for longer than maxAge are forgotten.
+type sessionRegistry struct {
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*pageSession
+	lastSweep time.Time
+}
+
+// newSessionRegistry returns a registry forgetting sessions after maxAge.
+func newSessionRegistry(maxAge time.Duration) *sessionRegistry {
+	return &sessionRegistry{
+		maxAge:   maxAge,
+		sessions: make(map[string]*pageSession),
+	}
+}
+
+// get returns the session with the given ID, starting a new one if it is
+// unknown or has expired. An empty ID always gets a new session which is not
+// remembered.
+//
+// A new session's root span is a child of parent if it is non-nil, or the
+// root of a new trace otherwise, and its time origin is origin.
+func (sr *sessionRegistry) get(id string, parent *appdash.SpanID, origin, now time.Time) pageSession {
+	if id == "" {
+		return newPageSession(parent, origin)
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if now.Sub(sr.lastSweep) > sr.maxAge {
+		sr.expire(now)
+	}
+	s, ok := sr.sessions[id]
+	if ok && now.Sub(s.lastSeen) > sr.maxAge {
+		// Expired since the last sweep.
+		ok = false
+	}
+	if !ok {
+		ns := newPageSession(parent, origin)
+		s = &ns
+		sr.sessions[id] = s
+	}
+	s.lastSeen = now
+	ret := *s
+	ret.First = !ok
+	return ret
+}
+
+// expire forgets the sessions not seen since maxAge before now. get sweeps
+// the registry with it at most once per maxAge, rather than on every beacon,
+// and checks the session it returns itself. The caller must hold sr.mu.
+func (sr *sessionRegistry) expire(now time.Time) {
+	for id, s := range sr.sessions {
+		if now.Sub(s.lastSeen) > sr.maxAge {
+			delete(sr.sessions, id)
+		}
+	}
+	sr.lastSweep = now
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEndpointSession(t *testing.T) {
+	a, c := newTestApp(Config{})
+	for _, body := range []string{
+		`[{"sessionId": "s1", "name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 100},
+		  {"sessionId": "s1", "name": "/a.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20}]`,
+		`[{"sessionId": "s1", "name": "/b.js", "entryType": "resource", "startOffsetMs": 150, "durationMs": 20}]`,
+		`[{"sessionId": "s2", "name": "/c.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 20}]`,
+	} {
+		if w := postPayload(a, "/endpoint", body); w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+
+	ids := make(map[string]uint64)
+	for _, name := range []string{"/a.js", "/b.js", "/c.js"} {
+		id, ok := c.named(name)
+		if !ok {
+			t.Fatalf("%s: not recorded", name)
+		}
+		ids[name] = uint64(id.Trace)
+	}
+	if ids["/a.js"] != ids["/b.js"] {
+		t.Errorf("batches of session s1 recorded into traces %x and %x, want one", ids["/a.js"], ids["/b.js"])
+	}
+	if ids["/c.js"] == ids["/a.js"] {
+		t.Errorf("sessions s1 and s2 share trace %x", ids["/a.js"])
+	}
+}
+
+func TestSessionRegistryExpires(t *testing.T) {
+	sr := newSessionRegistry(time.Minute)
+	now := time.Now()
+	first := sr.get("s1", nil, now, now)
+	if !first.First {
+		t.Error("first get: session not new")
+	}
+	if s := sr.get("s1", nil, now, now.Add(30*time.Second)); s.First || s.Root != first.Root || !s.Origin.Equal(now) {
+		t.Errorf("within maxAge: got session %+v, want %+v", s, first)
+	}
+	// Each beacon keeps the session alive for another maxAge.
+	if s := sr.get("s1", nil, now, now.Add(80*time.Second)); s.Root != first.Root {
+		t.Error("seen 50s ago: session forgotten")
+	}
+	if s := sr.get("s1", nil, now, now.Add(3*time.Minute)); !s.First || s.Root == first.Root {
+		t.Error("past maxAge: session not forgotten")
+	}
+	if len(sr.sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sr.sessions))
+	}
+
+	// Sessions without an ID are never remembered.
+	if a, b := sr.get("", nil, now, now), sr.get("", nil, now, now); a.Root == b.Root {
+		t.Error("sessions without an ID share a trace")
+	}
+}
+
+func TestSessionRegistrySweeps(t *testing.T) {
+	sr := newSessionRegistry(time.Minute)
+	now := time.Now()
+	sr.get("x", nil, now, now)
+	sr.get("a", nil, now, now.Add(10*time.Second))
+	sr.get("b", nil, now, now.Add(65*time.Second)) // sweeps x
+
+	// a has expired, but the registry isn't swept again until a minute
+	// after the last sweep: a is only forgotten when asked for.
+	sr.get("b", nil, now, now.Add(80*time.Second))
+	if len(sr.sessions) != 2 {
+		t.Errorf("got %d sessions before the sweep, want 2", len(sr.sessions))
+	}
+	if s := sr.get("a", nil, now, now.Add(80*time.Second)); !s.First {
+		t.Error("past maxAge: session a not forgotten")
+	}
+
+	sr.get("b", nil, now, now.Add(200*time.Second))
+	if _, ok := sr.sessions["a"]; ok || len(sr.sessions) != 1 {
+		t.Errorf("got %d sessions after the sweep, want only b", len(sr.sessions))
+	}
+}
+
+func TestEndpointSessionOrigin(t *testing.T) {
+	// The page says it sent its first batch 5s after its time origin: its
+	// navigation started then, not when the batch was received.
+	before := time.Now()
+	a, c := newTestApp(Config{})
+	for _, body := range []string{
+		`{"v": 1, "sessionId": "s1", "sentAtMs": 5000, "entries": [
+			{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900}]}`,
+		// Later batches keep the origin of the first.
+		`{"v": 1, "sessionId": "s1", "sentAtMs": 9000, "entries": [
+			{"name": "/a.js", "entryType": "resource", "startOffsetMs": 7000, "durationMs": 250}]}`,
+	} {
+		if w := postPayload(a, "/endpoint", body); w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+	}
+	after := time.Now()
+
+	origin := pageOrigin(t, c)
+	if origin.Before(before.Add(-5*time.Second)) || origin.After(after.Add(-5*time.Second)) {
+		t.Errorf("got time origin %v, want 5s before the batch was received (%v to %v)", origin, before, after)
+	}
+	e, ok := c.resources(t)["/a.js"]
+	if !ok {
+		t.Fatal("/a.js: not recorded")
+	}
+	if got := e.Start().Sub(origin); got != 7000*time.Millisecond {
+		t.Errorf("/a.js: got offset %v from the time origin, want 7s", got)
+	}
+}
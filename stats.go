@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// durationStats summarizes the load durations of a group of resources. The
+// percentiles are in milliseconds; Count tells whether there were enough
+// samples for them to be meaningful. Slow and Large count the resources
+// flagged as such (see ResourceEvent).
+type durationStats struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P90   float64 `json:"p90Ms"`
+	P99   float64 `json:"p99Ms"`
+	Slow  int     `json:"slow"`
+	Large int     `json:"large"`
+}
+
+// Stats serves the percentiles of the load durations of all resources
+// currently retained in the store, and how many of them are slow or large,
+// grouped by initiator type, as JSON.
+func (a *App) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	traces, err := a.Queryer.Traces()
+	if err != nil {
+		slog.Error("querying traces", "handler", "stats", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+
+	byType := make(map[string][]time.Duration)
+	slow, large := make(map[string]int), make(map[string]int)
+	for _, e := range resourceEvents(traces) {
+		byType[e.InitiatorType] = append(byType[e.InitiatorType], e.Duration)
+		if e.Slow {
+			slow[e.InitiatorType]++
+		}
+		if e.Large {
+			large[e.InitiatorType]++
+		}
+	}
+	stats := make(map[string]durationStats, len(byType))
+	for typ, ds := range byType {
+		s := newDurationStats(ds)
+		s.Slow, s.Large = slow[typ], large[typ]
+		stats[typ] = s
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// newDurationStats computes the statistics of ds, sorting it in place.
+func newDurationStats(ds []time.Duration) durationStats {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return durationStats{
+		Count: len(ds),
+		P50:   percentile(ds, 50),
+		P90:   percentile(ds, 90),
+		P99:   percentile(ds, 99),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted durations ds in
+// milliseconds, using the nearest-rank method.
+func percentile(ds []time.Duration, p float64) float64 {
+	if len(ds) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(ds))))
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(ds[rank-1]) / float64(time.Millisecond)
+}
+
+// resourceEvents returns the ResourceEvents recorded anywhere in traces.
+func resourceEvents(traces []*appdash.Trace) []ResourceEvent {
+	var events []ResourceEvent
+	var walk func(t *appdash.Trace)
+	walk = func(t *appdash.Trace) {
+		var e ResourceEvent
+		if err := appdash.UnmarshalEvent(t.Span.Annotations, &e); err == nil {
+			events = append(events, e)
+		}
+		for _, sub := range t.Sub {
+			walk(sub)
+		}
+	}
+	for _, t := range traces {
+		walk(t)
+	}
+	return events
+}
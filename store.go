@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// newStore returns the MemoryStore traces are kept in, and the store to
+// record them into: the MemoryStore wrapped by a RecentStore with an
+// eviction time of evictAge (i.e. all data older than that is deleted from
+// memory). A zero or negative evictAge disables eviction, using the
+// MemoryStore directly.
+//
+// With the "lru" kind of store the number of traces is bounded as well,
+// however much traffic arrives within evictAge: once there are more than
+// maxTraces, the oldest are deleted.
+func newStore(kind string, evictAge time.Duration, maxTraces int) (*appdash.MemoryStore, appdash.Store) {
+	memStore := appdash.NewMemoryStore()
+	var deleteStore appdash.DeleteStore = memStore
+	if kind == "lru" {
+		deleteStore = &appdash.LimitStore{
+			Max:         maxTraces,
+			DeleteStore: memStore,
+		}
+	}
+	if evictAge <= 0 {
+		return memStore, deleteStore
+	}
+	return memStore, &appdash.RecentStore{
+		MinEvictAge: evictAge,
+		DeleteStore: deleteStore,
+	}
+}
+
+// loadStore reads the traces previously saved to path and records them into
+// s. A missing file is not an error: there is simply nothing to load yet.
+//
+// The traces are replayed through s, oldest first, rather than read straight
+// into the MemoryStore underneath it: a RecentStore or LimitStore only knows
+// of the traces collected through it, and would otherwise never evict the
+// loaded ones.
+func loadStore(s appdash.Store, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	saved := appdash.NewMemoryStore()
+	if _, err := saved.ReadFrom(f); err != nil {
+		return err
+	}
+	traces, err := saved.Traces()
+	if err != nil {
+		return err
+	}
+	starts := make(map[*appdash.Trace]time.Time, len(traces))
+	for _, t := range traces {
+		starts[t], _ = pageLoadTimespan(t, resourceEvents([]*appdash.Trace{t}))
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return starts[traces[i]].Before(starts[traces[j]]) })
+	for _, t := range traces {
+		if err := replayTrace(s, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayTrace collects every span of t into c, parents first.
+func replayTrace(c appdash.Collector, t *appdash.Trace) error {
+	if err := c.Collect(t.Span.ID, t.Span.Annotations...); err != nil {
+		return err
+	}
+	for _, sub := range t.Sub {
+		if err := replayTrace(c, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveStore writes the traces in s to path. It writes to a temporary file
+// first and renames it into place, so a crash mid-write never leaves a
+// truncated store behind.
+func saveStore(s appdash.PersistentStore, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := s.Write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// recordPageLoad records a page load which started at start into c, as a
+// trace of a root span and a resource, and returns its ID.
+func recordPageLoad(c appdash.Collector, start time.Time) appdash.ID {
+	root := appdash.NewRootSpanID()
+	rec := appdash.NewRecorder(root, c)
+	rec.Event(&NavigationEvent{URL: "/", NavigationStart: start, LoadEventEnd: start.Add(time.Second)})
+	child := rec.Child()
+	child.Name("/a.js")
+	child.Event(&ResourceEvent{URL: "/a.js", FetchStart: start, ResponseEnd: start.Add(100 * time.Millisecond)})
+	return root.Trace
+}
+
+// savedStore saves n page loads, a minute apart, to a file and returns its
+// path and the IDs of the traces, oldest first.
+func savedStore(t *testing.T, n int) (string, []appdash.ID) {
+	t.Helper()
+	ms := appdash.NewMemoryStore()
+	var ids []appdash.ID
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		ids = append(ids, recordPageLoad(ms, start.Add(time.Duration(i)*time.Minute)))
+	}
+	path := filepath.Join(t.TempDir(), "loadtimes.db")
+	if err := saveStore(ms, path); err != nil {
+		t.Fatal(err)
+	}
+	return path, ids
+}
+
+func TestLoadStore(t *testing.T) {
+	path, ids := savedStore(t, 3)
+	ms := appdash.NewMemoryStore()
+	if err := loadStore(ms, path); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		tr, err := ms.Trace(id)
+		if err != nil {
+			t.Fatalf("trace %s: %s", id, err)
+		}
+		if len(tr.Sub) != 1 || tr.Sub[0].Span.Name() != "/a.js" {
+			t.Errorf("trace %s: resource span not loaded", id)
+		}
+	}
+
+	// Nothing saved yet is nothing to load.
+	if err := loadStore(appdash.NewMemoryStore(), filepath.Join(t.TempDir(), "missing.db")); err != nil {
+		t.Errorf("loading a missing file: %s", err)
+	}
+}
+
+func TestLoadStoreEvicts(t *testing.T) {
+	t.Run("LimitStore", func(t *testing.T) {
+		path, ids := savedStore(t, 3)
+		ms := appdash.NewMemoryStore()
+		if err := loadStore(&appdash.LimitStore{Max: 2, DeleteStore: ms}, path); err != nil {
+			t.Fatal(err)
+		}
+		// The oldest of the loaded traces made way for the others.
+		if _, err := ms.Trace(ids[0]); err == nil {
+			t.Errorf("oldest trace %s kept, want it evicted", ids[0])
+		}
+		for _, id := range ids[1:] {
+			if _, err := ms.Trace(id); err != nil {
+				t.Errorf("trace %s: %s", id, err)
+			}
+		}
+	})
+
+	t.Run("RecentStore", func(t *testing.T) {
+		path, ids := savedStore(t, 2)
+		ms := appdash.NewMemoryStore()
+		rs := &appdash.RecentStore{MinEvictAge: 10 * time.Millisecond, DeleteStore: ms}
+		if err := loadStore(rs, path); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		recordPageLoad(rs, time.Now())
+		for _, id := range ids {
+			if _, err := ms.Trace(id); err == nil {
+				t.Errorf("loaded trace %s kept past the eviction age", id)
+			}
+		}
+	})
+}
+
+func TestNewStore(t *testing.T) {
+	ms, s := newStore("memory", 10*time.Minute, 0)
+	rs, ok := s.(*appdash.RecentStore)
+	if !ok {
+		t.Fatalf("got a %T, want a *appdash.RecentStore", s)
+	}
+	if rs.MinEvictAge != 10*time.Minute {
+		t.Errorf("got eviction age %s, want 10m", rs.MinEvictAge)
+	}
+	if rs.DeleteStore != appdash.DeleteStore(ms) {
+		t.Errorf("RecentStore wraps a %T, want the MemoryStore", rs.DeleteStore)
+	}
+
+	// A zero or negative age disables eviction.
+	for _, age := range []time.Duration{0, -time.Second} {
+		if ms, s := newStore("memory", age, 0); s != appdash.Store(ms) {
+			t.Errorf("age %s: got a %T, want the MemoryStore itself", age, s)
+		}
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loadtimes.db")
+	a, ms := newStoreApp(Config{})
+
+	// Beacons of different page loads keep coming in while the store is
+	// saved.
+	var wg sync.WaitGroup
+	traces := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.ReplaceAll(testPayload, "test-session", fmt.Sprintf("session-%d", i))
+			w := postPayload(a, "/endpoint", body)
+			var resp endpointResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			traces <- resp.Trace
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		if err := saveStore(ms, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	close(traces)
+	if err := saveStore(ms, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened, as on restart, every trace can be queried again.
+	reopened, _ := newStoreApp(Config{})
+	if err := loadStore(reopened.Collector.(appdash.Store), path); err != nil {
+		t.Fatal(err)
+	}
+	for trace := range traces {
+		id, err := appdash.ParseID(trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := reopened.findTrace(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr == nil {
+			t.Errorf("trace %s lost", trace)
+			continue
+		}
+		if got := len(resourceEvents([]*appdash.Trace{tr})); got != 3 {
+			t.Errorf("trace %s: got %d resources, want 3", trace, got)
+		}
+	}
+}
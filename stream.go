@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxStreamSubscribers caps the number of clients connected to Stream at
+// once, each of which holds a goroutine and a channel.
+const maxStreamSubscribers = 100
+
+// streamKeepAlive is how often Stream sends a comment to idle clients, so
+// that proxies don't time the connection out.
+const streamKeepAlive = 30 * time.Second
+
+// batchSummary summarizes a batch of entries recorded by Endpoint, for the
+// clients of Stream.
+type batchSummary struct {
+	Trace     string           `json:"trace"`
+	PagePath  string           `json:"pagePath"`
+	Resources int              `json:"resources"`
+	Slowest   *resourceSummary `json:"slowest,omitempty"`
+
+	// Entries are all the resources recorded, for Live. They are left out
+	// of Stream's summaries, which are meant to stay small.
+	Entries []resourceSummary `json:"-"`
+}
+
+// newBatchSummary summarizes the resources recorded from a batch posted by
+// the page at path into trace.
+func newBatchSummary(trace, path string, recorded []*ResourceEvent) batchSummary {
+	s := batchSummary{Trace: trace, PagePath: path, Resources: len(recorded)}
+	for _, e := range recorded {
+		rs := resourceSummary{
+			Name:          e.URL,
+			DurationMs:    float64(e.Duration) / float64(time.Millisecond),
+			InitiatorType: e.InitiatorType,
+		}
+		if s.Slowest == nil || e.Duration > msDuration(s.Slowest.DurationMs) {
+			slowest := rs
+			s.Slowest = &slowest
+		}
+		s.Entries = append(s.Entries, rs)
+	}
+	return s
+}
+
+// broadcaster fans the batch summaries published by Endpoint out to the
+// clients subscribed through Stream and Live.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan batchSummary]bool
+
+	done      chan struct{} // closed by close
+	closeOnce sync.Once
+}
+
+// newBroadcaster returns a broadcaster with no subscribers.
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subs: make(map[chan batchSummary]bool),
+		done: make(chan struct{}),
+	}
+}
+
+// close ends the streams of all subscribers, which would otherwise hold up
+// the server's graceful shutdown until it times out.
+func (b *broadcaster) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// subscribe returns a channel receiving the summaries published from now on,
+// or false if there are maxStreamSubscribers already.
+func (b *broadcaster) subscribe() (chan batchSummary, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) >= maxStreamSubscribers {
+		return nil, false
+	}
+	ch := make(chan batchSummary, 16)
+	b.subs[ch] = true
+	return ch, true
+}
+
+// unsubscribe stops sending summaries to ch.
+func (b *broadcaster) unsubscribe(ch chan batchSummary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// publish sends s to every subscriber. A subscriber too slow to keep up
+// misses it rather than holding up Endpoint.
+func (b *broadcaster) publish(s batchSummary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
+// Stream pushes a summary of every batch of entries Endpoint records to the
+// client as Server-Sent Events, for live dashboards.
+func (a *App) Stream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported", "")
+		return
+	}
+	ch, ok := a.Broadcaster.subscribe()
+	if !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, "too many subscribers", fmt.Sprintf("limit is %d", maxStreamSubscribers))
+		return
+	}
+	defer a.Broadcaster.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.Broadcaster.done:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case s := <-ch:
+			data, err := json.Marshal(s)
+			if err != nil {
+				slog.Error("encoding batch summary", "trace_id", s.Trace, "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: batch\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
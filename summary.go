@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// defaultSummarySize is how many of the slowest resources Summary lists when
+// no n query parameter is given.
+const defaultSummarySize = 10
+
+// traceSummary is the JSON body served by Summary.
+type traceSummary struct {
+	Trace      string            `json:"trace"`
+	DurationMs float64           `json:"durationMs"` // of the whole page load
+	Resources  int               `json:"resources"`
+	TotalBytes int64             `json:"totalTransferBytes"`
+	Slowest    []resourceSummary `json:"slowest"`
+
+	// RenderBlocking lists the resources which held up the first render of
+	// the page, slowest first (see renderBlocking).
+	RenderBlocking []resourceSummary `json:"renderBlocking"`
+}
+
+// resourceSummary is one of the slowest resources of a traceSummary.
+type resourceSummary struct {
+	Name          string  `json:"name"`
+	DurationMs    float64 `json:"durationMs"`
+	InitiatorType string  `json:"initiatorType"`
+
+	// RenderBlocking is set on the resources which held up the first
+	// render of the page.
+	RenderBlocking bool `json:"renderBlocking,omitempty"`
+}
+
+// Summary serves a summary of the trace given by the trace query parameter
+// as JSON: the duration of the page load, the bytes transferred for it, its
+// n slowest resources (n defaults to defaultSummarySize) and its
+// render-blocking resources.
+func (a *App) Summary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	id, err := appdash.ParseID(r.URL.Query().Get("trace"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid trace ID", err.Error())
+		return
+	}
+	n := defaultSummarySize
+	if s := r.URL.Query().Get("n"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid n", s)
+			return
+		}
+	}
+	trace, err := a.findTrace(id)
+	if err != nil {
+		slog.Error("querying traces", "handler", "summary", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+	if trace == nil {
+		writeJSONError(w, http.StatusNotFound, "trace not found", id.String())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newTraceSummary(trace, n))
+}
+
+// newTraceSummary summarizes t, listing its n slowest resources.
+func newTraceSummary(t *appdash.Trace, n int) traceSummary {
+	events := resourceEvents([]*appdash.Trace{t})
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Duration > events[j].Duration })
+
+	s := traceSummary{
+		Trace:          t.Span.ID.Trace.String(),
+		Resources:      len(events),
+		Slowest:        []resourceSummary{},
+		RenderBlocking: []resourceSummary{},
+	}
+	nav, _ := navigationEvent(t)
+	for i, e := range events {
+		blocking := renderBlocking(e, nav)
+		if e.TransferSize > 0 {
+			s.TotalBytes += e.TransferSize
+		}
+		rs := resourceSummary{
+			Name:           e.URL,
+			DurationMs:     float64(e.Duration) / float64(time.Millisecond),
+			InitiatorType:  e.InitiatorType,
+			RenderBlocking: blocking,
+		}
+		if i < n {
+			s.Slowest = append(s.Slowest, rs)
+		}
+		if blocking {
+			s.RenderBlocking = append(s.RenderBlocking, rs)
+		}
+	}
+	start, end := pageLoadTimespan(t, events)
+	s.DurationMs = float64(end.Sub(start)) / float64(time.Millisecond)
+	return s
+}
+
+// pageLoadTimespan returns when the page load traced by t started and
+// ended, given its resource events. The page load lasts from navigation
+// start to the end of the load event, if the navigation entry was posted;
+// otherwise we only know when the first resource started and the last one
+// finished. Both are zero if neither is known.
+func pageLoadTimespan(t *appdash.Trace, events []ResourceEvent) (start, end time.Time) {
+	if nav, ok := navigationEvent(t); ok && !nav.LoadEventEnd.IsZero() {
+		return nav.Start(), nav.End()
+	}
+	for _, e := range events {
+		if start.IsZero() || e.FetchStart.Before(start) {
+			start = e.FetchStart
+		}
+		if e.ResponseEnd.After(end) {
+			end = e.ResponseEnd
+		}
+	}
+	return start, end
+}
+
+// renderBlocking reports whether the resource e held up the first render of
+// the page loaded by nav: stylesheets and scripts (the "link" and "script"
+// initiator types) which finished loading before the DOMContentLoaded event
+// started. Navigation events recorded without that milestone block nothing.
+func renderBlocking(e ResourceEvent, nav NavigationEvent) bool {
+	if nav.DOMContentLoadedStart.IsZero() {
+		return false
+	}
+	if e.InitiatorType != "link" && e.InitiatorType != "script" {
+		return false
+	}
+	return e.ResponseEnd.Before(nav.DOMContentLoadedStart)
+}
+
+// navigationEvent returns the NavigationEvent recorded in t, if any.
+func navigationEvent(t *appdash.Trace) (NavigationEvent, bool) {
+	var e NavigationEvent
+	if err := appdash.UnmarshalEvent(t.Span.Annotations, &e); err == nil {
+		return e, true
+	}
+	for _, sub := range t.Sub {
+		if e, ok := navigationEvent(sub); ok {
+			return e, true
+		}
+	}
+	return e, false
+}
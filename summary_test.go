@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	trace := ingest(t, a, testPayload)
+
+	w := get(a.Summary, "/summary?trace="+trace+"&n=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var s map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"trace", "durationMs", "resources", "totalTransferBytes", "slowest", "renderBlocking"} {
+		if _, ok := s[k]; !ok {
+			t.Errorf("missing key %q", k)
+		}
+	}
+	var sum traceSummary
+	b, _ := json.Marshal(s)
+	json.Unmarshal(b, &sum)
+
+	if sum.Trace != trace || sum.Resources != 3 {
+		t.Errorf("got trace %s with %d resources, want %s with 3", sum.Trace, sum.Resources, trace)
+	}
+	if sum.DurationMs != 480.5 {
+		t.Errorf("got duration %vms, want 480.5ms", sum.DurationMs)
+	}
+	// The font's size is unknown, so only app.js and style.css count.
+	if sum.TotalBytes != 20480+3000 {
+		t.Errorf("got %d bytes transferred, want %d", sum.TotalBytes, 20480+3000)
+	}
+	var names []string
+	for _, r := range sum.Slowest {
+		names = append(names, r.Name)
+	}
+	if len(names) != 2 || names[0] != "https://cdn.example.com/app.js" || names[1] != "https://fonts.example.net/font.woff2" {
+		t.Errorf("got slowest %q, want app.js (95.5ms) then the font (60ms)", names)
+	}
+	if len(sum.Slowest) > 0 && (sum.Slowest[0].DurationMs != 95.5 || sum.Slowest[0].InitiatorType != "script") {
+		t.Errorf("got slowest %+v, want a 95.5ms script", sum.Slowest[0])
+	}
+
+	// The default n lists them all.
+	w = get(a.Summary, "/summary?trace="+trace)
+	json.NewDecoder(w.Body).Decode(&sum)
+	if len(sum.Slowest) != 3 {
+		t.Errorf("default n: got %d slowest, want 3", len(sum.Slowest))
+	}
+
+	for target, code := range map[string]int{
+		"/summary?trace=" + trace + "&n=-1": http.StatusBadRequest,
+		"/summary?trace=xyz":                http.StatusBadRequest,
+		"/summary?trace=0123456789abcdef":   http.StatusNotFound,
+	} {
+		if w := get(a.Summary, target); w.Code != code {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+func TestSummaryRenderBlocking(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	trace := ingest(t, a, `{"v": 1, "entries": [
+		{"name": "/", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 900,
+		 "domContentLoadedEventStart": 300, "domContentLoadedEventEnd": 310, "loadEventEnd": 900},
+		{"name": "/head.js", "entryType": "resource", "initiatorType": "script", "startOffsetMs": 50, "durationMs": 150},
+		{"name": "/style.css", "entryType": "resource", "initiatorType": "link", "startOffsetMs": 50, "durationMs": 200},
+		{"name": "/late.js", "entryType": "resource", "initiatorType": "script", "startOffsetMs": 250, "durationMs": 150},
+		{"name": "/logo.png", "entryType": "resource", "initiatorType": "img", "startOffsetMs": 50, "durationMs": 50}
+	]}`)
+
+	w := get(a.Summary, "/summary?trace="+trace)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var sum traceSummary
+	if err := json.NewDecoder(w.Body).Decode(&sum); err != nil {
+		t.Fatal(err)
+	}
+	var blocking []string
+	for _, r := range sum.RenderBlocking {
+		blocking = append(blocking, r.Name)
+	}
+	// Slowest first, like the rest of the summary.
+	if len(blocking) != 2 || blocking[0] != "/style.css" || blocking[1] != "/head.js" {
+		t.Errorf("got render-blocking %q, want /style.css then /head.js", blocking)
+	}
+	for _, r := range sum.Slowest {
+		want := r.Name == "/style.css" || r.Name == "/head.js"
+		if r.RenderBlocking != want {
+			t.Errorf("%s: got renderBlocking %v, want %v", r.Name, r.RenderBlocking, want)
+		}
+	}
+}
+
+func TestRenderBlockingWithoutDOMContentLoaded(t *testing.T) {
+	e := ResourceEvent{InitiatorType: "script", ResponseEnd: time.Now()}
+	if renderBlocking(e, NavigationEvent{}) {
+		t.Error("got a resource blocking a page load without DOMContentLoaded, want none")
+	}
+	if !renderBlocking(e, NavigationEvent{DOMContentLoadedStart: e.ResponseEnd.Add(time.Millisecond)}) {
+		t.Error("got a script finished before DOMContentLoaded not blocking")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLSConfig returns the TLS configuration the app and web UI are served
+// with: the certificate in -tls-cert and -tls-key, or certificates obtained
+// from Let's Encrypt for -tls-autocert-domain. It returns nil if neither is
+// set, to serve plain HTTP.
+//
+// With -tls-autocert-domain it also returns the handler to serve on
+// -tls-autocert-http-addr (port 80): it answers Let's Encrypt's HTTP-01
+// challenges, and redirects everything else to HTTPS. Without it, only the
+// TLS-ALPN-01 challenge is possible, which requires the app to be served on
+// port 443.
+//
+// Pages served over HTTPS can only post their beacons to an HTTPS endpoint.
+func serverTLSConfig() (*tls.Config, http.Handler, error) {
+	switch {
+	case *tlsCert != "":
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	case *tlsAutocertDomain != "":
+		var domains []string
+		for _, d := range strings.Split(*tlsAutocertDomain, ",") {
+			domains = append(domains, strings.TrimSpace(d))
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(*tlsAutocertCache),
+		}
+		return m.TLSConfig(), m.HTTPHandler(nil), nil
+	}
+	return nil, nil, nil
+}
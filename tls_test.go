@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerTLSConfigAutocert(t *testing.T) {
+	defer func(domain, cache string) { *tlsAutocertDomain, *tlsAutocertCache = domain, cache }(*tlsAutocertDomain, *tlsAutocertCache)
+	*tlsAutocertDomain = "rum.example.com, www.example.com"
+	*tlsAutocertCache = filepath.Join(t.TempDir(), "autocert")
+
+	cfg, acme, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil || cfg.GetCertificate == nil {
+		t.Fatal("got no TLS config getting certificates from Let's Encrypt")
+	}
+	if acme == nil {
+		t.Fatal("got no handler for the HTTP-01 challenges")
+	}
+
+	// The challenges are answered (none is pending, hence 404), and the
+	// rest redirected to HTTPS.
+	w := httptest.NewRecorder()
+	acme.ServeHTTP(w, httptest.NewRequest("GET", "http://rum.example.com/.well-known/acme-challenge/token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("challenge: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	w = httptest.NewRecorder()
+	acme.ServeHTTP(w, httptest.NewRequest("GET", "http://rum.example.com/", nil))
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, "https://rum.example.com/") {
+		t.Errorf("other request: got status %d to %q, want a redirect to HTTPS", w.Code, loc)
+	}
+}
+
+func TestServerTLSConfigPlain(t *testing.T) {
+	cfg, acme, err := serverTLSConfig()
+	if cfg != nil || acme != nil || err != nil {
+		t.Errorf("without TLS flags: got %v, %v, %v, want nothing", cfg, acme, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+// defaultTracesLimit and maxTracesLimit are the default and the largest
+// number of traces TracesJSON lists at once.
+const (
+	defaultTracesLimit = 50
+	maxTracesLimit     = 1000
+)
+
+// traceListing is one trace listed by TracesJSON. Its total duration is in
+// milliseconds, and its timestamp is when the page load started.
+type traceListing struct {
+	ID         string    `json:"traceID"`
+	Name       string    `json:"name"`
+	PageURL    string    `json:"pageURL,omitempty"`
+	Start      time.Time `json:"timestamp"`
+	DurationMs float64   `json:"totalDuration"`
+	Resources  int       `json:"resourceCount"`
+}
+
+// TracesJSON serves the page loads in the store as a JSON array, newest
+// first, for tools which would otherwise scrape the web UI. It lists the
+// latest limit traces (defaultTracesLimit by default, at most
+// maxTracesLimit) which started after since and before before (both RFC
+// 3339, and optional). To page back through them, pass the start of the
+// last trace of a page as the before of the next.
+//
+// Traces whose start is unknown, such as those of API requests with no page
+// load, are left out.
+func (a *App) TracesJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed", r.Method)
+		return
+	}
+	if a.Queryer == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "no trace store", "spans are sent to a remote collector")
+		return
+	}
+	limit := defaultTracesLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTracesLimit {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit", s)
+			return
+		}
+		limit = n
+	}
+	var since, before time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"before", &before}} {
+		if s := r.URL.Query().Get(p.name); s != "" {
+			var err error
+			*p.t, err = time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid "+p.name, err.Error())
+				return
+			}
+		}
+	}
+	traces, err := a.Queryer.Traces()
+	if err != nil {
+		slog.Error("querying traces", "handler", "traces.json", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "error querying traces", err.Error())
+		return
+	}
+
+	listings := []traceListing{}
+	for _, t := range traces {
+		l, ok := newTraceListing(t)
+		if !ok || !l.Start.After(since) || (!before.IsZero() && !l.Start.Before(before)) {
+			continue
+		}
+		listings = append(listings, l)
+	}
+	sort.Slice(listings, func(i, j int) bool {
+		if !listings[i].Start.Equal(listings[j].Start) {
+			return listings[i].Start.After(listings[j].Start)
+		}
+		return listings[i].ID > listings[j].ID
+	})
+	if len(listings) > limit {
+		listings = listings[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listings)
+}
+
+// newTraceListing lists the trace t, or returns false if when it started
+// isn't known.
+func newTraceListing(t *appdash.Trace) (traceListing, bool) {
+	events := resourceEvents([]*appdash.Trace{t})
+	start, end := pageLoadTimespan(t, events)
+	if start.IsZero() {
+		return traceListing{}, false
+	}
+	l := traceListing{
+		ID:         t.Span.ID.Trace.String(),
+		Name:       t.Span.Name(),
+		Start:      start,
+		DurationMs: float64(end.Sub(start)) / float64(time.Millisecond),
+		Resources:  len(events),
+	}
+	if page, ok := pageEvent(t); ok {
+		l.PageURL = page.PageURL
+	}
+	return l, true
+}
+
+// pageEvent returns the PageEvent recorded in t, if any. It is on the root
+// span of the page load, which is nested under the span of the request
+// which served the page, if known.
+func pageEvent(t *appdash.Trace) (PageEvent, bool) {
+	var e PageEvent
+	if err := appdash.UnmarshalEvent(t.Span.Annotations, &e); err == nil {
+		return e, true
+	}
+	for _, sub := range t.Sub {
+		if e, ok := pageEvent(sub); ok {
+			return e, true
+		}
+	}
+	return e, false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/appdash"
+)
+
+func TestTracesJSON(t *testing.T) {
+	a, ms := newStoreApp(Config{})
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var ids []appdash.ID // oldest first
+	for i := 0; i < 5; i++ {
+		ids = append(ids, recordPageLoad(ms, start.Add(time.Duration(i)*time.Minute)))
+	}
+	list := func(query string) []traceListing {
+		t.Helper()
+		w := get(a.TracesJSON, "/traces.json?"+query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d: %s", query, w.Code, http.StatusOK, w.Body)
+		}
+		var ls []traceListing
+		if err := json.NewDecoder(w.Body).Decode(&ls); err != nil {
+			t.Fatal(err)
+		}
+		return ls
+	}
+	check := func(query string, want ...appdash.ID) {
+		t.Helper()
+		ls := list(query)
+		var got []string
+		for _, l := range ls {
+			got = append(got, l.ID)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got traces %q, want %d", query, got, len(want))
+			return
+		}
+		for i := range want {
+			if got[i] != want[i].String() {
+				t.Errorf("%s: got traces %q, want %q newest first", query, got, want)
+				return
+			}
+		}
+	}
+
+	// The latest traces are listed, not the oldest ones.
+	check("limit=2", ids[4], ids[3])
+	check("", ids[4], ids[3], ids[2], ids[1], ids[0])
+	// Paging back from the last trace listed.
+	check("limit=2&before="+url.QueryEscape(start.Add(3*time.Minute).Format(time.RFC3339Nano)), ids[2], ids[1])
+	check("since="+url.QueryEscape(start.Add(2*time.Minute).Format(time.RFC3339Nano)), ids[4], ids[3])
+
+	if l := list("limit=1")[0]; l.Resources != 1 || l.DurationMs != 1000 || !l.Start.Equal(start.Add(4*time.Minute)) {
+		t.Errorf("got %+v, want a 1000ms page load with 1 resource", l)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "since=yesterday", "before=1"} {
+		if w := get(a.TracesJSON, "/traces.json?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTracesJSONKeys(t *testing.T) {
+	a, _ := newStoreApp(Config{})
+	first := ingest(t, a, testPayload)
+	second := ingest(t, a, `{"v": 1, "entries": [
+		{"sessionId": "second-session", "pageUrl": "http://localhost:8699/about",
+		 "name": "http://localhost:8699/about", "entryType": "navigation", "startOffsetMs": 0, "durationMs": 200, "loadEventEnd": 200},
+		{"sessionId": "second-session", "name": "/a.js", "entryType": "resource", "startOffsetMs": 10, "durationMs": 50}
+	]}`)
+
+	w := get(a.TracesJSON, "/traces.json?limit=10")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var listings []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&listings); err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]map[string]any)
+	for _, l := range listings {
+		for _, k := range []string{"traceID", "pageURL", "resourceCount", "totalDuration", "timestamp"} {
+			if _, ok := l[k]; !ok {
+				t.Errorf("listing %v: missing key %q", l["traceID"], k)
+			}
+		}
+		id, _ := l["traceID"].(string)
+		byID[id] = l
+	}
+	for trace, want := range map[string]struct {
+		pageURL   string
+		resources float64
+		duration  float64
+	}{
+		first:  {"http://localhost:8699/", 3, 480.5},
+		second: {"http://localhost:8699/about", 1, 200},
+	} {
+		l, ok := byID[trace]
+		if !ok {
+			t.Errorf("trace %s not listed", trace)
+			continue
+		}
+		if l["pageURL"] != want.pageURL || l["resourceCount"] != want.resources || l["totalDuration"] != want.duration {
+			t.Errorf("trace %s: got %v, want page %s with %v resources over %vms", trace, l, want.pageURL, want.resources, want.duration)
+		}
+	}
+}